@@ -0,0 +1,451 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jdaiv/px-server/rpg"
+)
+
+// how long anything outside the game loop waits on it before giving up
+const GAME_LOOP_TIMEOUT = 10 * time.Second
+
+var errGameTimeout = errors.New("timed out waiting for the game loop")
+
+type adminHandler func(w http.ResponseWriter, r *http.Request, admin User)
+
+// requireAdmin checks the request's bearer token belongs to a superuser.
+// The flag is read from the DB so a demoted admin loses access straight
+// away, rather than when their token expires.
+func requireAdmin(action ActionStr, handler adminHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(header, "Bearer ")
+		if token == "" || token == header {
+			adminErr(w, http.StatusUnauthorized, action, ErrorUnauthenticated)
+			return
+		}
+
+		claims, err := ParseToken(token, TOKEN_TYPE_ACCESS)
+		if err != nil {
+			adminErr(w, http.StatusUnauthorized, action, err.(ClientError))
+			return
+		}
+
+		user, err := LoadUser(claims.NameNormal)
+		if err != nil || user.Id != claims.Subject {
+			adminErr(w, http.StatusUnauthorized, action, ErrorInvalidToken)
+			return
+		}
+		if !user.SuperUser {
+			log.Printf("[api/admin] %s tried to use %s without being a superuser", user.NameNormal, action)
+			adminErr(w, http.StatusForbidden, action, ErrorForbidden)
+			return
+		}
+
+		handler(w, r, user)
+	}
+}
+
+func adminErr(w http.ResponseWriter, status int, action ActionStr, err ClientError) {
+	w.WriteHeader(status)
+	jsonErr(w, action, err)
+}
+
+// adminStorageErr reports a failed DB write, features that need postgres
+// get a 503 when running without it.
+func adminStorageErr(w http.ResponseWriter, action ActionStr, err error) {
+	cErr := storageErr(err)
+	if cErr == ErrorNoDatabase {
+		adminErr(w, http.StatusServiceUnavailable, action, cErr)
+		return
+	}
+	adminErr(w, http.StatusInternalServerError, action, cErr)
+}
+
+func adminOk(w http.ResponseWriter, action ActionStr, data interface{}) {
+	jsonWrite(w, WSResponse{
+		Error:   0,
+		Message: "success",
+		Action:  action,
+		Data:    data,
+	})
+}
+
+// audit records an admin action, failing to write it doesn't stop the
+// action but is logged loudly.
+func audit(admin User, action ActionStr, target string, details interface{}) {
+	log.Printf("[api/admin] %s: %s %s %v", admin.NameNormal, action, target, details)
+
+	detailsStr := ""
+	if details != nil {
+		encoded, err := json.Marshal(details)
+		if err != nil {
+			log.Printf("[api/admin] error encoding audit details: %v", err)
+		}
+		detailsStr = string(encoded)
+	}
+
+	if !hasDB() {
+		return
+	}
+	_, err := DB.Exec(`INSERT INTO admin_audit(admin_id, action, target, details)
+        VALUES ($1, $2, $3, $4)`, admin.Id, string(action), target, detailsStr)
+	if err != nil {
+		log.Printf("[api/admin] error writing audit log: %v", err)
+	}
+}
+
+// targetUser loads the user named in the request's "user" field.
+func targetUser(w http.ResponseWriter, r *http.Request, action ActionStr) (User, bool) {
+	user, err := LoadUser(normalizeUsername(r.FormValue("user")))
+	if err == ErrorUserMissing {
+		adminErr(w, http.StatusNotFound, action, ErrorUserMissing)
+		return user, false
+	} else if err != nil {
+		adminErr(w, http.StatusInternalServerError, action, ErrorInternal)
+		return user, false
+	}
+	return user, true
+}
+
+// runOnGameLoop hands a message to the game loop and waits for it to be
+// handled, anything touching game state has to go through here.
+func runOnGameLoop(msg rpg.IncomingMessage) error {
+	msg.Done = make(chan error, 1)
+	timeout := time.After(GAME_LOOP_TIMEOUT)
+	select {
+	case game.Incoming <- msg:
+	case <-timeout:
+		return errGameTimeout
+	}
+	select {
+	case err := <-msg.Done:
+		return err
+	case <-timeout:
+		return errGameTimeout
+	}
+}
+
+func gameErr(w http.ResponseWriter, action ActionStr, err error) {
+	if err == errGameTimeout {
+		log.Printf("[api/admin] %s: %v", action, err)
+		adminErr(w, http.StatusGatewayTimeout, action, ErrorInternal)
+		return
+	}
+	adminErr(w, http.StatusBadRequest, action, RPGClientError(err))
+}
+
+// disconnectUser kicks a connected user, or removes them from the world if
+// they're linkdead. Returns false if they weren't online.
+func disconnectUser(id int, reason ClientError) bool {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+
+	if c, ok := authenticatedClients[id]; ok {
+		c.Kick(reason)
+		return true
+	}
+	if ld, ok := linkdeadClients[id]; ok {
+		delete(linkdeadClients, id)
+		playerLeft(ld.User, false)
+		return true
+	}
+	return false
+}
+
+type adminClientInfo struct {
+	Id        int    `json:"id"`
+	Name      string `json:"name"`
+	SuperUser bool   `json:"superuser"`
+	Addr      string `json:"addr,omitempty"`
+	Codec     string `json:"codec,omitempty"`
+	Protocol  int    `json:"protocol"`
+	Linkdead  bool   `json:"linkdead"`
+	Zone      int    `json:"zone"`
+	ZoneName  string `json:"zoneName"`
+}
+
+func adminClients(w http.ResponseWriter, r *http.Request, admin User) {
+	zones := make(map[int]rpg.ZoneStats)
+	for _, z := range game.ZoneStats() {
+		for _, id := range z.PlayerIds {
+			zones[id] = z
+		}
+	}
+
+	list := make([]adminClientInfo, 0)
+	clientsMutex.Lock()
+	for id, c := range authenticatedClients {
+		list = append(list, adminClientInfo{
+			Id:        id,
+			Name:      c.User.Name,
+			SuperUser: c.User.SuperUser,
+			Addr:      c.Conn.RemoteAddr().String(),
+			Codec:     c.codec.Name(),
+			Protocol:  c.ProtocolVersion,
+			Zone:      zones[id].Id,
+			ZoneName:  zones[id].Name,
+		})
+	}
+	for id, ld := range linkdeadClients {
+		list = append(list, adminClientInfo{
+			Id:        id,
+			Name:      ld.User.Name,
+			SuperUser: ld.User.SuperUser,
+			Linkdead:  true,
+			Zone:      zones[id].Id,
+			ZoneName:  zones[id].Name,
+		})
+	}
+	clientsMutex.Unlock()
+
+	audit(admin, ACTION_ADMIN_CLIENTS, "", nil)
+	adminOk(w, ACTION_ADMIN_CLIENTS, list)
+}
+
+func adminKick(w http.ResponseWriter, r *http.Request, admin User) {
+	user, ok := targetUser(w, r, ACTION_ADMIN_KICK)
+	if !ok {
+		return
+	}
+	reason := r.FormValue("reason")
+
+	if !KickUser(user, admin, reason) {
+		adminErr(w, http.StatusNotFound, ACTION_ADMIN_KICK, ErrorUserMissing)
+		return
+	}
+
+	audit(admin, ACTION_ADMIN_KICK, user.NameNormal, map[string]string{"reason": reason})
+	adminOk(w, ACTION_ADMIN_KICK, nil)
+}
+
+func adminBan(w http.ResponseWriter, r *http.Request, admin User) {
+	user, ok := targetUser(w, r, ACTION_ADMIN_BAN)
+	if !ok {
+		return
+	}
+	if user.Id == admin.Id {
+		adminErr(w, http.StatusBadRequest, ACTION_ADMIN_BAN, ErrorInvalidData)
+		return
+	}
+	reason := r.FormValue("reason")
+
+	seconds, ok := formSeconds(w, r, ACTION_ADMIN_BAN)
+	if !ok {
+		return
+	}
+
+	if err := BanUser(user, admin, reason, time.Duration(seconds)*time.Second); err != nil {
+		log.Printf("[api/admin] error banning %s: %v", user.NameNormal, err)
+		adminStorageErr(w, ACTION_ADMIN_BAN, err)
+		return
+	}
+
+	audit(admin, ACTION_ADMIN_BAN, user.NameNormal, map[string]interface{}{
+		"reason":   reason,
+		"duration": seconds,
+	})
+	adminOk(w, ACTION_ADMIN_BAN, nil)
+}
+
+// formSeconds reads the "duration" field in seconds, missing or 0 is
+// permanent.
+func formSeconds(w http.ResponseWriter, r *http.Request, action ActionStr) (int, bool) {
+	durationStr := r.FormValue("duration")
+	if durationStr == "" {
+		return 0, true
+	}
+	seconds, err := strconv.Atoi(durationStr)
+	if err != nil || seconds < 0 {
+		adminErr(w, http.StatusBadRequest, action, ErrorInvalidData)
+		return 0, false
+	}
+	return seconds, true
+}
+
+func adminUnban(w http.ResponseWriter, r *http.Request, admin User) {
+	user, ok := targetUser(w, r, ACTION_ADMIN_UNBAN)
+	if !ok {
+		return
+	}
+	reason := r.FormValue("reason")
+
+	if err := UnbanUser(user, admin, reason); err != nil {
+		log.Printf("[api/admin] error unbanning %s: %v", user.NameNormal, err)
+		adminStorageErr(w, ACTION_ADMIN_UNBAN, err)
+		return
+	}
+
+	audit(admin, ACTION_ADMIN_UNBAN, user.NameNormal, map[string]string{"reason": reason})
+	adminOk(w, ACTION_ADMIN_UNBAN, nil)
+}
+
+func adminMute(w http.ResponseWriter, r *http.Request, admin User) {
+	user, ok := targetUser(w, r, ACTION_ADMIN_MUTE)
+	if !ok {
+		return
+	}
+	reason := r.FormValue("reason")
+	seconds, ok := formSeconds(w, r, ACTION_ADMIN_MUTE)
+	if !ok {
+		return
+	}
+
+	if err := MuteUser(user, admin, reason, time.Duration(seconds)*time.Second); err != nil {
+		log.Printf("[api/admin] error muting %s: %v", user.NameNormal, err)
+		adminStorageErr(w, ACTION_ADMIN_MUTE, err)
+		return
+	}
+
+	audit(admin, ACTION_ADMIN_MUTE, user.NameNormal, map[string]interface{}{
+		"reason":   reason,
+		"duration": seconds,
+	})
+	adminOk(w, ACTION_ADMIN_MUTE, nil)
+}
+
+func adminUnmute(w http.ResponseWriter, r *http.Request, admin User) {
+	user, ok := targetUser(w, r, ACTION_ADMIN_UNMUTE)
+	if !ok {
+		return
+	}
+	reason := r.FormValue("reason")
+
+	if err := UnmuteUser(user, admin, reason); err != nil {
+		log.Printf("[api/admin] error unmuting %s: %v", user.NameNormal, err)
+		adminStorageErr(w, ACTION_ADMIN_UNMUTE, err)
+		return
+	}
+
+	audit(admin, ACTION_ADMIN_UNMUTE, user.NameNormal, map[string]string{"reason": reason})
+	adminOk(w, ACTION_ADMIN_UNMUTE, nil)
+}
+
+func adminModerationLog(w http.ResponseWriter, r *http.Request, admin User) {
+	targetId := 0
+	target := ""
+	if r.FormValue("user") != "" {
+		user, ok := targetUser(w, r, ACTION_MODERATION_LOG)
+		if !ok {
+			return
+		}
+		targetId = user.Id
+		target = user.NameNormal
+	}
+	before, _ := strconv.Atoi(r.FormValue("before"))
+	limit, _ := strconv.Atoi(r.FormValue("limit"))
+
+	entries, err := ModerationLog(targetId, before, limit)
+	if err != nil {
+		log.Printf("[api/admin] error reading moderation log: %v", err)
+		adminStorageErr(w, ACTION_MODERATION_LOG, err)
+		return
+	}
+
+	audit(admin, ACTION_MODERATION_LOG, target, nil)
+	adminOk(w, ACTION_MODERATION_LOG, entries)
+}
+
+func adminBroadcast(w http.ResponseWriter, r *http.Request, admin User) {
+	message := r.FormValue("message")
+	if len(message) <= 0 || len(message) > 256 {
+		adminErr(w, http.StatusBadRequest, ACTION_ADMIN_BROADCAST, ErrorInvalidData)
+		return
+	}
+
+	BroadcastToAll(ACTION_CHAT_MESSAGE, recordChat(chatRecord{
+		Message: messageSend{
+			Content: message,
+			From:    "server",
+			Class:   MESSAGE_CLASS_SERVER,
+			Channel: CHAT_CHANNEL_GLOBAL,
+		},
+	}))
+
+	audit(admin, ACTION_ADMIN_BROADCAST, "", map[string]string{"message": message})
+	adminOk(w, ACTION_ADMIN_BROADCAST, nil)
+}
+
+func adminSave(w http.ResponseWriter, r *http.Request, admin User) {
+	err := runOnGameLoop(rpg.IncomingMessage{
+		Data: rpg.IncomingMessageData{Type: rpg.ACTION_SAVE},
+	})
+	if err != nil {
+		gameErr(w, ACTION_ADMIN_SAVE, err)
+		return
+	}
+
+	audit(admin, ACTION_ADMIN_SAVE, "", nil)
+	adminOk(w, ACTION_ADMIN_SAVE, nil)
+}
+
+func adminTeleport(w http.ResponseWriter, r *http.Request, admin User) {
+	user, ok := targetUser(w, r, ACTION_ADMIN_TELEPORT)
+	if !ok {
+		return
+	}
+
+	// action params are decoded JSON, so numbers are float64
+	params := make(map[string]interface{})
+	for _, field := range []string{"zone", "x", "y"} {
+		valueStr := r.FormValue(field)
+		if valueStr == "" {
+			continue
+		}
+		value, err := strconv.Atoi(valueStr)
+		if err != nil {
+			adminErr(w, http.StatusBadRequest, ACTION_ADMIN_TELEPORT, ErrorInvalidData)
+			return
+		}
+		params[field] = float64(value)
+	}
+
+	err := runOnGameLoop(rpg.IncomingMessage{
+		PlayerId: user.Id,
+		Data: rpg.IncomingMessageData{
+			Type:   rpg.ACTION_TELEPORT,
+			Params: params,
+		},
+	})
+	if err != nil {
+		gameErr(w, ACTION_ADMIN_TELEPORT, err)
+		return
+	}
+
+	audit(admin, ACTION_ADMIN_TELEPORT, user.NameNormal, params)
+	adminOk(w, ACTION_ADMIN_TELEPORT, nil)
+}
+
+func adminSuperUser(w http.ResponseWriter, r *http.Request, admin User) {
+	user, ok := targetUser(w, r, ACTION_ADMIN_SUPERUSER)
+	if !ok {
+		return
+	}
+	superUser, err := strconv.ParseBool(r.FormValue("superuser"))
+	if err != nil {
+		adminErr(w, http.StatusBadRequest, ACTION_ADMIN_SUPERUSER, ErrorInvalidData)
+		return
+	}
+
+	if err := SetSuperUser(user.Id, superUser); err != nil {
+		log.Printf("[api/admin] error updating superuser for %s: %v", user.NameNormal, err)
+		adminErr(w, http.StatusInternalServerError, ACTION_ADMIN_SUPERUSER, ErrorInternal)
+		return
+	}
+
+	// connected clients pick it up without logging in again
+	clientsMutex.Lock()
+	if c, ok := authenticatedClients[user.Id]; ok {
+		c.User.SuperUser = superUser
+	}
+	clientsMutex.Unlock()
+
+	audit(admin, ACTION_ADMIN_SUPERUSER, user.NameNormal, map[string]bool{"superuser": superUser})
+	adminOk(w, ACTION_ADMIN_SUPERUSER, nil)
+}
@@ -4,24 +4,40 @@ import (
 	"log"
 )
 
-func loginHandler(source *Client, data []byte) (interface{}, error) {
+func loginHandler(source *Client, requestId string, data []byte) (interface{}, error) {
 	var tokenStr string
 
-	err := parseIncoming(data, &tokenStr)
+	if source.ProtocolVersion == 0 {
+		return nil, ErrorHelloRequired
+	}
+
+	err := parseIncoming(source, data, &tokenStr)
 	if err != nil {
 		return nil, ErrorInvalidData
 	}
 
-	if err := source.Authenticate(tokenStr); err != nil {
+	claims, err := ParseToken(tokenStr, TOKEN_TYPE_ACCESS)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := source.Authenticate(claims); err != nil {
 		return nil, err
 	}
 
 	log.Printf("[ws/auth] %s logged in as %s (%v)",
 		source.Conn.RemoteAddr(), source.User.NameNormal, source.User.SuperUser)
 
-	return WSResponse{
+	// the login response goes out first so the client knows who it is
+	// before the scrollback arrives
+	source.Write(WSResponse{
+		Id:     requestId,
 		Error:  0,
 		Action: ACTION_LOGIN,
 		Data:   map[string]string{"name": source.User.Name},
-	}, nil
+	})
+	sendChatBacklog(source, CHAT_CHANNEL_GLOBAL, 0)
+	sendChatBacklog(source, CHAT_CHANNEL_WHISPER, source.User.Id)
+
+	return nil, nil
 }
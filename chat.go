@@ -1,38 +1,55 @@
 package main
 
-import "log"
+import (
+	"log"
+	"strings"
 
-// import (
-// 	"log"
-// )
+	"github.com/jdaiv/px-server/rpg"
+)
 
 const (
 	MESSAGE_CLASS_NORMAL = ""
 	MESSAGE_CLASS_SERVER = "server"
+	MESSAGE_CLASS_EMOTE  = "emote"
+
+	// everyone in the same zone
+	CHAT_CHANNEL_SAY = "say"
+	// everyone online, messages without a channel go here so older clients
+	// keep working
+	CHAT_CHANNEL_GLOBAL = "global"
+	// a single player, named in To
+	CHAT_CHANNEL_WHISPER = "whisper"
 )
 
 type (
 	messageRecv struct {
 		Content string `json:"content"`
+		Channel string `json:"channel"`
+		To      string `json:"to"`
 	}
 	messageSend struct {
 		From    string `json:"from"`
 		Content string `json:"content"`
 		Class   string `json:"class"`
+		Channel string `json:"channel,omitempty"`
+		To      string `json:"to,omitempty"`
+		// set once a message is recorded in the history, Time is unix ms
+		Id   int64 `json:"id,omitempty"`
+		Time int64 `json:"time,omitempty"`
 	}
 	roomList struct {
 		Rooms []string `json:"rooms"`
 	}
 )
 
-func handleChatMessage(source *Client, data []byte) (interface{}, error) {
+func handleChatMessage(source *Client, requestId string, data []byte) (interface{}, error) {
 	if !source.Authenticated {
 		return nil, ErrorUnauthenticated
 	}
 
 	var msg messageRecv
 
-	if err := parseIncoming(data, &msg); err != nil {
+	if err := parseIncoming(source, data, &msg); err != nil {
 		return nil, err
 	}
 
@@ -40,17 +57,106 @@ func handleChatMessage(source *Client, data []byte) (interface{}, error) {
 		return nil, ErrorInvalidData
 	}
 
-	BroadcastToAll(ACTION_CHAT_MESSAGE, messageSend{
-		Content: msg.Content,
-		From:    source.User.Name,
-	})
+	if strings.HasPrefix(msg.Content, "/") {
+		return nil, runChatCommand(source, requestId, msg.Content)
+	}
+
+	content, err := checkMessage(source, msg.Content)
+	if err != nil {
+		return nil, err
+	}
+	msg.Content = content
+
+	if msg.Channel == "" {
+		msg.Channel = CHAT_CHANNEL_GLOBAL
+	}
 
-	log.Printf("[chat] %s: %s", source.User.NameNormal, msg.Content)
+	switch msg.Channel {
+	case CHAT_CHANNEL_GLOBAL:
+		BroadcastToAll(ACTION_CHAT_MESSAGE, recordChat(chatRecord{
+			Message: messageSend{
+				Content: msg.Content,
+				From:    source.User.Name,
+				Channel: CHAT_CHANNEL_GLOBAL,
+			},
+		}))
+	case CHAT_CHANNEL_SAY:
+		// zone membership belongs to the game loop, so it sends these out
+		game.Incoming <- rpg.IncomingMessage{
+			PlayerId: source.User.Id,
+			Data: rpg.IncomingMessageData{
+				Type:   rpg.ACTION_SAY,
+				Params: map[string]interface{}{"message": msg.Content},
+			},
+		}
+	case CHAT_CHANNEL_WHISPER:
+		if err := whisper(source, msg); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrorInvalidData
+	}
+
+	log.Printf("[chat/%s] %s: %s", msg.Channel, source.User.NameNormal, msg.Content)
 
 	return nil, nil
 }
 
-func handleListUsers(source *Client, data []byte) (interface{}, error) {
+// checkMessage makes sure the client's allowed to talk and runs the message
+// through the word filter. Banned users still connected are kicked.
+func checkMessage(source *Client, content string) (string, error) {
+	if err := checkCanChat(source.User); err != nil {
+		if err == ErrorBanned {
+			source.Kick(ErrorBanned)
+		}
+		return "", err
+	}
+	filtered, ok := wordFilter.Apply(content)
+	if !ok {
+		log.Printf("[chat] blocked message from %s: %s", source.User.NameNormal, content)
+		return "", ErrorMessageBlocked
+	}
+	return filtered, nil
+}
+
+// whisper sends a message to a single player, and echoes it back to the
+// sender so it shows up in their chat too.
+func whisper(source *Client, msg messageRecv) error {
+	target, err := LoadUser(normalizeUsername(msg.To))
+	if err != nil {
+		return ErrorUserMissing
+	}
+
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+
+	client, ok := authenticatedClients[target.Id]
+	if !ok {
+		return ErrorUserMissing
+	}
+
+	response := WSResponse{
+		Error:  0,
+		Action: ACTION_CHAT_MESSAGE,
+		Data: recordChat(chatRecord{
+			Message: messageSend{
+				Content: msg.Content,
+				From:    source.User.Name,
+				Channel: CHAT_CHANNEL_WHISPER,
+				To:      target.Name,
+			},
+			FromId: source.User.Id,
+			ToId:   target.Id,
+		}),
+	}
+	client.Write(response)
+	if client != source {
+		source.Write(response)
+	}
+	return nil
+}
+
+func handleListUsers(source *Client, requestId string, data []byte) (interface{}, error) {
 	list := make([]string, 0)
 
 	clientsMutex.Lock()
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jdaiv/px-server/rpg"
+)
+
+const (
+	MAX_DICE = 100
+	MAX_DIE  = 1000
+)
+
+type chatCommand struct {
+	usage     string
+	help      string
+	args      int
+	superUser bool
+	// commands that talk are blocked for muted users and what they say goes
+	// through the word filter, named ones start with a player's name that
+	// isn't part of it
+	talks bool
+	named bool
+	// commands that wait on the game loop run on their own goroutine, so
+	// a busy loop doesn't hold up everyone else's messages
+	game bool
+	run  func(source *Client, args []string) error
+}
+
+var chatCommands map[string]chatCommand
+
+// registered in init since /help reads the table
+func init() {
+	chatCommands = map[string]chatCommand{
+		"help":     {"", "list commands", 0, false, false, false, false, cmdHelp},
+		"who":      {"", "list who's online", 0, false, false, false, false, cmdWho},
+		"w":        {"<name> <message>", "whisper to a player", 2, false, true, true, false, cmdWhisper},
+		"me":       {"<action>", "describe what you're doing", 1, false, true, false, false, cmdMe},
+		"roll":     {"[dice]", "roll some dice, like 1d20", 0, false, true, false, false, cmdRoll},
+		"stuck":    {"", "go back to the start, if you're not fighting", 0, false, false, false, true, cmdStuck},
+		"tp":       {"[name] <zone> [x] [y]", "teleport yourself or someone else", 1, true, false, false, true, cmdTeleport},
+		"spawn":    {"npc <type>", "spawn an npc next to you", 2, true, false, false, true, cmdSpawn},
+		"give":     {"<item> [name]", "give yourself or someone else an item", 1, true, false, false, true, cmdGive},
+		"kick":     {"<name> [reason]", "kick a player", 1, true, false, false, false, cmdKick},
+		"ban":      {"<name> <duration|perm> [reason]", "ban a player, durations look like 30m, 12h or 7d", 2, true, false, false, false, cmdBan},
+		"unban":    {"<name> [reason]", "lift a ban early", 1, true, false, false, false, cmdUnban},
+		"mute":     {"<name> <duration|perm> [reason]", "stop a player chatting", 2, true, false, false, false, cmdMute},
+		"unmute":   {"<name> [reason]", "lift a mute early", 1, true, false, false, false, cmdUnmute},
+		"modlog":   {"[name]", "show recent moderation actions", 0, true, false, false, false, cmdModLog},
+		"announce": {"<message>", "send a server message to everyone", 1, true, false, false, false, cmdAnnounce},
+	}
+}
+
+// runChatCommand handles a chat message starting with a slash.
+func runChatCommand(source *Client, requestId string, content string) error {
+	fields := strings.Fields(strings.TrimPrefix(content, "/"))
+	if len(fields) == 0 {
+		return ErrorUnknownCommand
+	}
+
+	name := strings.ToLower(fields[0])
+	cmd, ok := chatCommands[name]
+	if !ok {
+		return ErrorUnknownCommand
+	}
+	if cmd.superUser && !source.User.SuperUser {
+		return ErrorForbidden
+	}
+
+	args := fields[1:]
+	if len(args) < cmd.args {
+		reply(source, "usage: /%s %s", name, cmd.usage)
+		return nil
+	}
+
+	if cmd.talks {
+		// where what's said starts
+		said := 0
+		if cmd.named {
+			said = 1
+		}
+		filtered, err := checkMessage(source, strings.Join(args[said:], " "))
+		if err != nil {
+			return err
+		}
+		args = append(args[:said:said], strings.Fields(filtered)...)
+	}
+
+	run := func() error {
+		if err := cmd.run(source, args); err != nil {
+			return err
+		}
+		log.Printf("[chat/command] %s: %s", source.User.NameNormal, content)
+		if cmd.superUser {
+			audit(source.User, ACTION_ADMIN_COMMAND, "", map[string]string{"command": content})
+		}
+		return nil
+	}
+	if cmd.game {
+		go func() {
+			if err := run(); err != nil {
+				writeError(source, requestId, ACTION_CHAT_MESSAGE, err)
+			}
+		}()
+		return nil
+	}
+	return run()
+}
+
+// reply sends a server message to just the client that ran the command.
+func reply(source *Client, format string, args ...interface{}) {
+	source.Write(WSResponse{
+		Error:  0,
+		Action: ACTION_CHAT_MESSAGE,
+		Data: messageSend{
+			Content: fmt.Sprintf(format, args...),
+			From:    "server",
+			Class:   MESSAGE_CLASS_SERVER,
+		},
+	})
+}
+
+// commandGameErr turns the result of runOnGameLoop into something to send
+// back to the client.
+func commandGameErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	if err == errGameTimeout {
+		log.Printf("[chat/command] %v", err)
+		return ErrorInternal
+	}
+	return RPGClientError(err)
+}
+
+func cmdHelp(source *Client, args []string) error {
+	names := make([]string, 0, len(chatCommands))
+	for name, cmd := range chatCommands {
+		if !cmd.superUser || source.User.SuperUser {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		cmd := chatCommands[name]
+		usage := "/" + name
+		if cmd.usage != "" {
+			usage += " " + cmd.usage
+		}
+		lines = append(lines, fmt.Sprintf("%s - %s", usage, cmd.help))
+	}
+	reply(source, "%s", strings.Join(lines, "\n"))
+	return nil
+}
+
+func cmdWho(source *Client, args []string) error {
+	names := make([]string, 0)
+	clientsMutex.Lock()
+	for _, c := range authenticatedClients {
+		names = append(names, c.User.Name)
+	}
+	clientsMutex.Unlock()
+	sort.Strings(names)
+
+	reply(source, "%d online: %s", len(names), strings.Join(names, ", "))
+	return nil
+}
+
+func cmdWhisper(source *Client, args []string) error {
+	return whisper(source, messageRecv{
+		Content: strings.Join(args[1:], " "),
+		Channel: CHAT_CHANNEL_WHISPER,
+		To:      args[0],
+	})
+}
+
+// emote is said in the player's zone, shown as them doing something
+func emote(source *Client, text string) {
+	game.Incoming <- rpg.IncomingMessage{
+		PlayerId: source.User.Id,
+		Data: rpg.IncomingMessageData{
+			Type: rpg.ACTION_SAY,
+			Params: map[string]interface{}{
+				"message": text,
+				"emote":   true,
+			},
+		},
+	}
+}
+
+func cmdMe(source *Client, args []string) error {
+	emote(source, strings.Join(args, " "))
+	return nil
+}
+
+// parseDice reads dice like 2d6, or d6 for a single die.
+func parseDice(dice string) (int, int, bool) {
+	parts := strings.SplitN(strings.ToLower(dice), "d", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	count := 1
+	if parts[0] != "" {
+		var err error
+		if count, err = strconv.Atoi(parts[0]); err != nil {
+			return 0, 0, false
+		}
+	}
+	sides, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, false
+	}
+	if count < 1 || count > MAX_DICE || sides < 2 || sides > MAX_DIE {
+		return 0, 0, false
+	}
+	return count, sides, true
+}
+
+func cmdRoll(source *Client, args []string) error {
+	dice := "1d20"
+	if len(args) > 0 {
+		dice = args[0]
+	}
+	count, sides, ok := parseDice(dice)
+	if !ok {
+		reply(source, "usage: /roll [dice], like 1d20 or 3d6")
+		return nil
+	}
+
+	total := 0
+	for i := 0; i < count; i++ {
+		total += rand.Intn(sides) + 1
+	}
+	emote(source, fmt.Sprintf("rolls %dd%d: %d", count, sides, total))
+	return nil
+}
+
+func cmdStuck(source *Client, args []string) error {
+	err := runOnGameLoop(rpg.IncomingMessage{
+		PlayerId: source.User.Id,
+		Data:     rpg.IncomingMessageData{Type: rpg.ACTION_UNSTUCK},
+	})
+	return commandGameErr(err)
+}
+
+// onlineUser finds a connected player by name.
+func onlineUser(name string) (User, error) {
+	user, err := LoadUser(normalizeUsername(name))
+	if err != nil {
+		return user, ErrorUserMissing
+	}
+	clientsMutex.Lock()
+	_, online := authenticatedClients[user.Id]
+	clientsMutex.Unlock()
+	if !online {
+		return user, ErrorUserMissing
+	}
+	return user, nil
+}
+
+func cmdTeleport(source *Client, args []string) error {
+	target := source.User
+	// the name's optional, anything that isn't a number is one
+	if _, err := strconv.Atoi(args[0]); err != nil {
+		var uErr error
+		if target, uErr = onlineUser(args[0]); uErr != nil {
+			return uErr
+		}
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return ErrorInvalidData
+	}
+
+	params := make(map[string]interface{})
+	for i, field := range []string{"zone", "x", "y"} {
+		if i >= len(args) {
+			break
+		}
+		value, err := strconv.Atoi(args[i])
+		if err != nil {
+			return ErrorInvalidData
+		}
+		params[field] = float64(value)
+	}
+
+	err := runOnGameLoop(rpg.IncomingMessage{
+		PlayerId: target.Id,
+		Data: rpg.IncomingMessageData{
+			Type:   rpg.ACTION_TELEPORT,
+			Params: params,
+		},
+	})
+	return commandGameErr(err)
+}
+
+func cmdSpawn(source *Client, args []string) error {
+	if args[0] != "npc" {
+		reply(source, "usage: /spawn npc <type>")
+		return nil
+	}
+	err := runOnGameLoop(rpg.IncomingMessage{
+		PlayerId: source.User.Id,
+		Data: rpg.IncomingMessageData{
+			Type:   rpg.ACTION_SPAWN_NPC,
+			Params: map[string]interface{}{"type": args[1]},
+		},
+	})
+	return commandGameErr(err)
+}
+
+func cmdGive(source *Client, args []string) error {
+	target := source.User
+	if len(args) > 1 {
+		var err error
+		if target, err = onlineUser(args[1]); err != nil {
+			return err
+		}
+	}
+	err := runOnGameLoop(rpg.IncomingMessage{
+		PlayerId: target.Id,
+		Data: rpg.IncomingMessageData{
+			Type:   rpg.ACTION_GIVE_ITEM,
+			Params: map[string]interface{}{"type": args[0]},
+		},
+	})
+	if err != nil {
+		return commandGameErr(err)
+	}
+	reply(source, "gave %s to %s", args[0], target.Name)
+	return nil
+}
+
+func cmdKick(source *Client, args []string) error {
+	user, err := LoadUser(normalizeUsername(args[0]))
+	if err != nil {
+		return ErrorUserMissing
+	}
+	if !KickUser(user, source.User, strings.Join(args[1:], " ")) {
+		return ErrorUserMissing
+	}
+	reply(source, "kicked %s", user.Name)
+	return nil
+}
+
+// moderationArgs reads the name, duration and reason used by /ban and /mute.
+func moderationArgs(source *Client, args []string) (User, time.Duration, string, error) {
+	user, err := LoadUser(normalizeUsername(args[0]))
+	if err != nil {
+		return user, 0, "", ErrorUserMissing
+	}
+	if user.Id == source.User.Id {
+		return user, 0, "", ErrorInvalidData
+	}
+	duration, err := ParseModerationDuration(args[1])
+	if err != nil {
+		return user, 0, "", ErrorInvalidData
+	}
+	return user, duration, strings.Join(args[2:], " "), nil
+}
+
+func describeDuration(duration time.Duration) string {
+	if duration == 0 {
+		return "permanently"
+	}
+	return "for " + duration.String()
+}
+
+func cmdBan(source *Client, args []string) error {
+	user, duration, reason, err := moderationArgs(source, args)
+	if err != nil {
+		return err
+	}
+	if err := BanUser(user, source.User, reason, duration); err != nil {
+		log.Printf("[chat/command] error banning %s: %v", user.NameNormal, err)
+		return storageErr(err)
+	}
+	reply(source, "banned %s %s", user.Name, describeDuration(duration))
+	return nil
+}
+
+func cmdUnban(source *Client, args []string) error {
+	user, err := LoadUser(normalizeUsername(args[0]))
+	if err != nil {
+		return ErrorUserMissing
+	}
+	if err := UnbanUser(user, source.User, strings.Join(args[1:], " ")); err != nil {
+		log.Printf("[chat/command] error unbanning %s: %v", user.NameNormal, err)
+		return storageErr(err)
+	}
+	reply(source, "unbanned %s", user.Name)
+	return nil
+}
+
+func cmdMute(source *Client, args []string) error {
+	user, duration, reason, err := moderationArgs(source, args)
+	if err != nil {
+		return err
+	}
+	if err := MuteUser(user, source.User, reason, duration); err != nil {
+		log.Printf("[chat/command] error muting %s: %v", user.NameNormal, err)
+		return storageErr(err)
+	}
+	reply(source, "muted %s %s", user.Name, describeDuration(duration))
+	return nil
+}
+
+func cmdUnmute(source *Client, args []string) error {
+	user, err := LoadUser(normalizeUsername(args[0]))
+	if err != nil {
+		return ErrorUserMissing
+	}
+	if err := UnmuteUser(user, source.User, strings.Join(args[1:], " ")); err != nil {
+		log.Printf("[chat/command] error unmuting %s: %v", user.NameNormal, err)
+		return storageErr(err)
+	}
+	reply(source, "unmuted %s", user.Name)
+	return nil
+}
+
+func cmdModLog(source *Client, args []string) error {
+	targetId := 0
+	if len(args) > 0 {
+		user, err := LoadUser(normalizeUsername(args[0]))
+		if err != nil {
+			return ErrorUserMissing
+		}
+		targetId = user.Id
+	}
+
+	entries, err := ModerationLog(targetId, 0, 10)
+	if err != nil {
+		log.Printf("[chat/command] error reading moderation log: %v", err)
+		return storageErr(err)
+	}
+	if len(entries) == 0 {
+		reply(source, "nothing in the moderation log")
+		return nil
+	}
+
+	lines := make([]string, 0, len(entries))
+	for _, e := range entries {
+		line := fmt.Sprintf("%s %s %s %s", e.CreatedAt.Format("2006-01-02 15:04"), e.Moderator, e.Action, e.Target)
+		if e.ExpiresAt != nil {
+			line += " until " + e.ExpiresAt.Format("2006-01-02 15:04")
+		}
+		if e.Reason != "" {
+			line += ": " + e.Reason
+		}
+		lines = append(lines, line)
+	}
+	reply(source, "%s", strings.Join(lines, "\n"))
+	return nil
+}
+
+func cmdAnnounce(source *Client, args []string) error {
+	BroadcastToAll(ACTION_CHAT_MESSAGE, recordChat(chatRecord{
+		Message: messageSend{
+			Content: strings.Join(args, " "),
+			From:    "server",
+			Class:   MESSAGE_CLASS_SERVER,
+			Channel: CHAT_CHANNEL_GLOBAL,
+		},
+	}))
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/BurntSushi/toml"
+)
+
+const CHAT_FILTER_FILE = "chat_filter.toml"
+
+// chatFilter masks or blocks whole words, matching ignores case.
+type chatFilter struct {
+	mask  map[string]bool
+	block map[string]bool
+}
+
+var wordFilter = &chatFilter{
+	mask:  make(map[string]bool),
+	block: make(map[string]bool),
+}
+
+// LoadChatFilter reads the word lists from the resources directory, the
+// filter is just left empty if there's no file.
+func LoadChatFilter(resPath string) error {
+	var lists struct {
+		Mask  []string `toml:"mask"`
+		Block []string `toml:"block"`
+	}
+	if _, err := toml.DecodeFile(resPath+CHAT_FILTER_FILE, &lists); err != nil {
+		if os.IsNotExist(err) {
+			log.Printf("[chat] no %s, chat won't be filtered", CHAT_FILTER_FILE)
+			return nil
+		}
+		return err
+	}
+
+	filter := &chatFilter{
+		mask:  make(map[string]bool),
+		block: make(map[string]bool),
+	}
+	for _, w := range lists.Mask {
+		filter.mask[strings.ToLower(w)] = true
+	}
+	for _, w := range lists.Block {
+		filter.block[strings.ToLower(w)] = true
+	}
+	wordFilter = filter
+
+	log.Printf("[chat] loaded filter, %d masked and %d blocked words", len(filter.mask), len(filter.block))
+	return nil
+}
+
+// Apply returns the message with masked words starred out, or false if it
+// contains a blocked word and shouldn't be sent at all.
+func (f *chatFilter) Apply(text string) (string, bool) {
+	if len(f.mask) == 0 && len(f.block) == 0 {
+		return text, true
+	}
+
+	runes := []rune(text)
+	start := -1
+	for i := 0; i <= len(runes); i++ {
+		inWord := i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]))
+		if inWord && start < 0 {
+			start = i
+		}
+		if inWord || start < 0 {
+			continue
+		}
+
+		word := strings.ToLower(string(runes[start:i]))
+		if f.block[word] {
+			return "", false
+		}
+		if f.mask[word] {
+			for j := start; j < i; j++ {
+				runes[j] = '*'
+			}
+		}
+		start = -1
+	}
+
+	return string(runes), true
+}
@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestChatFilter(t *testing.T) {
+	filter := &chatFilter{
+		mask:  map[string]bool{"darn": true, "heck": true},
+		block: map[string]bool{"spam": true},
+	}
+
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"hello there", "hello there", true},
+		{"darn it", "**** it", true},
+		{"DARN it", "**** it", true},
+		{"oh heck, darn!", "oh ****, ****!", true},
+		{"darned", "darned", true},
+		{"buy spam now", "", false},
+		{"SPAM", "", false},
+		{"spammer", "spammer", true},
+		{"héck darn", "héck ****", true},
+		{"", "", true},
+	}
+	for _, test := range tests {
+		got, ok := filter.Apply(test.in)
+		if got != test.want || ok != test.ok {
+			t.Errorf("Apply(%q) = %q, %v, want %q, %v", test.in, got, ok, test.want, test.ok)
+		}
+	}
+
+	empty := &chatFilter{mask: map[string]bool{}, block: map[string]bool{}}
+	if got, ok := empty.Apply("darn spam"); got != "darn spam" || !ok {
+		t.Errorf("empty filter changed the message: %q, %v", got, ok)
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_CHAT_HISTORY_SIZE = 50
+	MAX_CHAT_HISTORY_PAGE     = 100
+	// messages waiting to be written to chat_log, past this they're dropped
+	CHAT_LOG_QUEUE_SIZE = 256
+)
+
+var chatHistorySize = DEFAULT_CHAT_HISTORY_SIZE
+var persistChat = false
+
+// chatRing keeps the last chatHistorySize messages for one channel, oldest
+// first.
+type chatRing struct {
+	items []messageSend
+	start int
+}
+
+func (r *chatRing) push(msg messageSend) {
+	if len(r.items) < chatHistorySize {
+		r.items = append(r.items, msg)
+		return
+	}
+	r.items[r.start] = msg
+	r.start = (r.start + 1) % len(r.items)
+}
+
+// before returns up to limit messages older than the id, oldest first. An
+// id of 0 means from the newest message.
+func (r *chatRing) before(id int64, limit int) []messageSend {
+	ordered := append(append([]messageSend{}, r.items[r.start:]...), r.items[:r.start]...)
+	end := len(ordered)
+	if id > 0 {
+		for end > 0 && ordered[end-1].Id >= id {
+			end--
+		}
+	}
+	start := end - limit
+	if start < 0 {
+		start = 0
+	}
+	return ordered[start:end]
+}
+
+// a single logged message, Zone is only set for say and the ids are only
+// set for whispers
+type chatRecord struct {
+	Message messageSend
+	Zone    int
+	FromId  int
+	ToId    int
+}
+
+type chatHistory struct {
+	Channel  string        `json:"channel"`
+	Messages []messageSend `json:"messages"`
+}
+
+type chatHistoryRequest struct {
+	Channel string `json:"channel"`
+	Before  int64  `json:"before"`
+	Limit   int    `json:"limit"`
+}
+
+var chatHistoryMutex = &sync.Mutex{}
+var chatRings = make(map[string]*chatRing)
+var lastChatId int64 = 0
+var chatLogQueue = make(chan chatRecord, CHAT_LOG_QUEUE_SIZE)
+
+// rings are keyed by channel, then zone or user for say and whispers
+func chatKey(channel string, id int) string {
+	if channel == CHAT_CHANNEL_GLOBAL {
+		return channel
+	}
+	return fmt.Sprintf("%s:%d", channel, id)
+}
+
+func ringFor(key string) *chatRing {
+	ring, ok := chatRings[key]
+	if !ok {
+		ring = &chatRing{items: make([]messageSend, 0, chatHistorySize)}
+		chatRings[key] = ring
+	}
+	return ring
+}
+
+func (rec chatRecord) keys() []string {
+	switch rec.Message.Channel {
+	case CHAT_CHANNEL_SAY:
+		return []string{chatKey(CHAT_CHANNEL_SAY, rec.Zone)}
+	case CHAT_CHANNEL_WHISPER:
+		keys := []string{chatKey(CHAT_CHANNEL_WHISPER, rec.FromId)}
+		if rec.ToId != rec.FromId {
+			keys = append(keys, chatKey(CHAT_CHANNEL_WHISPER, rec.ToId))
+		}
+		return keys
+	default:
+		return []string{chatKey(CHAT_CHANNEL_GLOBAL, 0)}
+	}
+}
+
+// recordChat gives a message its id and time and adds it to the history,
+// the returned message is the one to send out.
+func recordChat(rec chatRecord) messageSend {
+	if chatHistorySize <= 0 {
+		return rec.Message
+	}
+
+	chatHistoryMutex.Lock()
+	lastChatId += 1
+	rec.Message.Id = lastChatId
+	rec.Message.Time = time.Now().UnixNano() / int64(time.Millisecond)
+	for _, key := range rec.keys() {
+		ringFor(key).push(rec.Message)
+	}
+	chatHistoryMutex.Unlock()
+
+	if persistChat {
+		select {
+		case chatLogQueue <- rec:
+		default:
+			log.Printf("[chat] log queue full, dropping message %d", rec.Message.Id)
+		}
+	}
+
+	return rec.Message
+}
+
+// ChatHistory returns a page of a channel's history, oldest first. Older
+// messages come from chat_log once the ring buffer runs out.
+func ChatHistory(channel string, id int, before int64, limit int) ([]messageSend, error) {
+	if limit <= 0 || limit > MAX_CHAT_HISTORY_PAGE {
+		limit = MAX_CHAT_HISTORY_PAGE
+	}
+
+	messages := recentChat(channel, id, before, limit)
+	if !persistChat || len(messages) >= limit {
+		return messages, nil
+	}
+
+	if len(messages) > 0 {
+		before = messages[0].Id
+	}
+	older, err := loadChatLog(channel, id, before, limit-len(messages))
+	if err != nil {
+		return messages, err
+	}
+	return append(older, messages...), nil
+}
+
+// recentChat is ChatHistory from the ring buffer alone, it never goes to
+// the DB.
+func recentChat(channel string, id int, before int64, limit int) []messageSend {
+	chatHistoryMutex.Lock()
+	defer chatHistoryMutex.Unlock()
+	if ring, ok := chatRings[chatKey(channel, id)]; ok {
+		return ring.before(before, limit)
+	}
+	return make([]messageSend, 0)
+}
+
+func chatLogQuery(channel string) string {
+	switch channel {
+	case CHAT_CHANNEL_SAY:
+		return `channel = 'say' AND zone_id = $1`
+	case CHAT_CHANNEL_WHISPER:
+		return `channel = 'whisper' AND (from_id = $1 OR to_id = $1)`
+	default:
+		return `channel = 'global' AND $1 = 0`
+	}
+}
+
+func loadChatLog(channel string, id int, before int64, limit int) ([]messageSend, error) {
+	rows, err := DB.Query(`SELECT id, channel, from_name, to_name, content, class, created_at
+        FROM chat_log WHERE `+chatLogQuery(channel)+` AND ($2 = 0 OR id < $2)
+        ORDER BY id DESC LIMIT $3`, id, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := make([]messageSend, 0)
+	for rows.Next() {
+		var msg messageSend
+		var created time.Time
+		if err := rows.Scan(&msg.Id, &msg.Channel, &msg.From, &msg.To,
+			&msg.Content, &msg.Class, &created); err != nil {
+			return nil, err
+		}
+		msg.Time = created.UnixNano() / int64(time.Millisecond)
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// newest first out of the DB
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+// LoadChatHistory fills the ring buffers from chat_log and carries on the
+// message ids from where they left off.
+func LoadChatHistory() error {
+	if !persistChat || chatHistorySize <= 0 {
+		return nil
+	}
+
+	rows, err := DB.Query(`SELECT id, channel, zone_id, from_id, to_id, from_name, to_name, content, class, created_at
+        FROM chat_log WHERE id > (SELECT COALESCE(MAX(id), 0) FROM chat_log) - $1
+        ORDER BY id`, chatHistorySize*10)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	chatHistoryMutex.Lock()
+	defer chatHistoryMutex.Unlock()
+
+	for rows.Next() {
+		var rec chatRecord
+		var zone, fromId, toId sql.NullInt64
+		var created time.Time
+		msg := &rec.Message
+		if err := rows.Scan(&msg.Id, &msg.Channel, &zone, &fromId, &toId,
+			&msg.From, &msg.To, &msg.Content, &msg.Class, &created); err != nil {
+			return err
+		}
+		msg.Time = created.UnixNano() / int64(time.Millisecond)
+		rec.Zone = int(zone.Int64)
+		rec.FromId = int(fromId.Int64)
+		rec.ToId = int(toId.Int64)
+		for _, key := range rec.keys() {
+			ringFor(key).push(rec.Message)
+		}
+		lastChatId = msg.Id
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	err = DB.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM chat_log`).Scan(&lastChatId)
+	log.Printf("[chat] loaded history, continuing from message %d", lastChatId)
+	return err
+}
+
+func nullInt(i int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(i), Valid: i != 0}
+}
+
+// writeChatLog persists recorded messages in the background so chat never
+// waits on the DB.
+func writeChatLog() {
+	for rec := range chatLogQueue {
+		msg := rec.Message
+		_, err := DB.Exec(`INSERT INTO chat_log(id, channel, zone_id, from_id, to_id,
+                from_name, to_name, content, class, created_at)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+			msg.Id, msg.Channel, nullInt(rec.Zone), nullInt(rec.FromId), nullInt(rec.ToId),
+			msg.From, msg.To, msg.Content, msg.Class,
+			time.Unix(0, msg.Time*int64(time.Millisecond)))
+		if err != nil {
+			log.Printf("[chat] error writing chat log: %v", err)
+		}
+	}
+}
+
+// sendChatBacklog sends a client the recent history for a channel, used at
+// login and when they change zones. It only sends what's in the ring buffer,
+// zone changes happen with clientsMutex held on the way out of the game
+// loop, clients page further back with chat_history.
+func sendChatBacklog(c *Client, channel string, id int) {
+	if chatHistorySize <= 0 {
+		return
+	}
+	messages := recentChat(channel, id, 0, chatHistorySize)
+	if len(messages) == 0 {
+		return
+	}
+	c.Write(WSResponse{
+		Error:  0,
+		Action: ACTION_CHAT_HISTORY,
+		Data:   chatHistory{Channel: channel, Messages: messages},
+	})
+}
+
+func handleChatHistory(source *Client, requestId string, data []byte) (interface{}, error) {
+	if !source.Authenticated {
+		return nil, ErrorUnauthenticated
+	}
+
+	var req chatHistoryRequest
+	if err := parseIncoming(source, data, &req); err != nil {
+		return nil, err
+	}
+
+	id := 0
+	switch req.Channel {
+	case CHAT_CHANNEL_GLOBAL:
+	case CHAT_CHANNEL_SAY:
+		id = source.ChatZone()
+	case CHAT_CHANNEL_WHISPER:
+		id = source.User.Id
+	default:
+		return nil, ErrorInvalidData
+	}
+
+	messages, err := ChatHistory(req.Channel, id, req.Before, req.Limit)
+	if err != nil {
+		log.Printf("[chat] error loading history: %v", err)
+		return nil, ErrorInternal
+	}
+
+	return WSResponse{
+		Error:  0,
+		Action: ACTION_CHAT_HISTORY,
+		Data:   chatHistory{Channel: req.Channel, Messages: messages},
+	}, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestChatRingBefore(t *testing.T) {
+	defer func(size int) { chatHistorySize = size }(chatHistorySize)
+	chatHistorySize = 5
+
+	// ids 1 to 7 pushed into a ring of 5 leaves 3 to 7
+	ring := &chatRing{}
+	for id := int64(1); id <= 7; id++ {
+		ring.push(messageSend{Id: id})
+	}
+
+	tests := []struct {
+		name   string
+		before int64
+		limit  int
+		want   []int64
+	}{
+		{"newest", 0, 10, []int64{3, 4, 5, 6, 7}},
+		{"limited", 0, 2, []int64{6, 7}},
+		{"before an id", 6, 10, []int64{3, 4, 5}},
+		{"before an id, limited", 6, 2, []int64{4, 5}},
+		{"before the oldest", 3, 10, []int64{}},
+		{"before an id that's gone", 2, 10, []int64{}},
+		{"past the newest", 100, 10, []int64{3, 4, 5, 6, 7}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ids := make([]int64, 0)
+			for _, msg := range ring.before(test.before, test.limit) {
+				ids = append(ids, msg.Id)
+			}
+			if !reflect.DeepEqual(ids, test.want) {
+				t.Errorf("before(%d, %d) = %v, want %v", test.before, test.limit, ids, test.want)
+			}
+		})
+	}
+}
+
+func TestChatRingNotFull(t *testing.T) {
+	defer func(size int) { chatHistorySize = size }(chatHistorySize)
+	chatHistorySize = 5
+
+	ring := &chatRing{}
+	ring.push(messageSend{Id: 1})
+	ring.push(messageSend{Id: 2})
+	got := ring.before(0, 10)
+	if len(got) != 2 || got[0].Id != 1 || got[1].Id != 2 {
+		t.Errorf("before(0, 10) = %v, want ids 1 and 2", got)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jdaiv/px-server/rpg"
@@ -19,32 +20,106 @@ const (
 	CLOSED
 )
 
+const (
+	// disconnect the existing session and let the new one in
+	DUPLICATE_LOGIN_KICK_OLD = "kick_old"
+	// refuse the new login while the existing session is connected
+	DUPLICATE_LOGIN_REJECT_NEW = "reject_new"
+)
+
+var duplicateLoginPolicy = DUPLICATE_LOGIN_KICK_OLD
+
+const DEFAULT_LINKDEAD_TIMEOUT = 30 * 1e+9
+
+var linkdeadTimeout int64 = DEFAULT_LINKDEAD_TIMEOUT
+
+// a player whose connection dropped, kept around so a reconnect with the
+// same session can pick up where it left off
+type linkdeadSession struct {
+	User     User
+	Session  string
+	TimedOut bool
+	Since    int64
+}
+
+func ValidDuplicateLoginPolicy(policy string) bool {
+	return policy == DUPLICATE_LOGIN_KICK_OLD || policy == DUPLICATE_LOGIN_REJECT_NEW
+}
+
 type Client struct {
-	State         int
+	// atomic, the writer goroutine closes clients as well as the handlers,
+	// the game output and ClientMaintenace
+	state         atomic.Int32
 	Authenticated bool
 	User          User
+	Session       string
 	Conn          *websocket.Conn
 	LastPing      int64
+
+	codec Codec
+	// negotiated by the hello message
+	ProtocolVersion int
+	Features        map[string]bool
+
+	queue *outgoingQueue
+	// closed once the writer goroutine has finished
+	writerDone chan bool
+	limiter    *rateLimiter
+	// kicked players leave the world straight away instead of going linkdead
+	kicked atomic.Bool
+
+	// the last game state sent, deltas are built against this
+	stateMutex sync.Mutex
+	lastState  *rpg.DisplayData
+	// the zone the client was last sent say history for
+	chatZone int
 }
 
 var clientsMutex = &sync.Mutex{}
 var clients = make(map[*Client]bool)
 var authenticatedClients = make(map[int]*Client)
+var linkdeadClients = make(map[int]linkdeadSession)
 
-func MakeClient(conn *websocket.Conn) *Client {
+func MakeClient(conn *websocket.Conn, codec Codec) *Client {
 	client := &Client{
-		Conn:     conn,
-		State:    AWAITING_AUTH,
-		LastPing: time.Now().UnixNano(),
+		Conn:       conn,
+		codec:      codec,
+		LastPing:   time.Now().UnixNano(),
+		queue:      newOutgoingQueue(),
+		writerDone: make(chan bool),
+		limiter:    newRateLimiter(),
 	}
+	client.setState(AWAITING_AUTH)
 	clientsMutex.Lock()
 	clients[client] = true
 	clientsMutex.Unlock()
+	go client.writeMessages()
 	return client
 }
 
 func RemoveClient(client *Client) {
-	client.State = CLOSING
+	client.setState(CLOSING)
+}
+
+func (c *Client) State() int {
+	return int(c.state.Load())
+}
+
+func (c *Client) setState(state int) {
+	c.state.Store(int32(state))
+}
+
+// markClosing moves the client to CLOSING, false if it was already closing.
+func (c *Client) markClosing() bool {
+	for {
+		state := c.state.Load()
+		if state >= CLOSING {
+			return false
+		}
+		if c.state.CompareAndSwap(state, CLOSING) {
+			return true
+		}
+	}
 }
 
 func BroadcastToAll(action ActionStr, data interface{}) {
@@ -77,14 +152,14 @@ func ClientMaintenace() {
 		now := time.Now().UnixNano()
 		for c := range clients {
 			if now-c.LastPing > 10*1e+9 {
-				c.State = TIMED_OUT
+				c.setState(TIMED_OUT)
 			}
 		}
 
 		// find closed or timed out clients
 		toRemove := make([]*Client, 0)
 		for c := range clients {
-			if c.State >= CLOSING {
+			if c.State() >= CLOSING {
 				toRemove = append(toRemove, c)
 			}
 		}
@@ -92,25 +167,35 @@ func ClientMaintenace() {
 		// and remove
 		for _, c := range toRemove {
 			delete(clients, c)
-			if c.Authenticated {
-				game.Incoming <- rpg.IncomingMessage{
-					PlayerId: c.User.Id,
-					Data: rpg.IncomingMessageData{
-						Type: rpg.ACTION_LEAVE,
-					},
-				}
+			c.queue.Close()
+			// a client displaced by a newer login has already left
+			if current, ok := authenticatedClients[c.User.Id]; c.Authenticated && ok && current == c {
 				delete(authenticatedClients, c.User.Id)
-				message := "%s disconnected"
-				if c.State == TIMED_OUT {
-					message = "%s timed out"
+				if linkdeadTimeout > 0 && !c.kicked.Load() {
+					linkdeadClients[c.User.Id] = linkdeadSession{
+						User:     c.User,
+						Session:  c.Session,
+						TimedOut: c.State() == TIMED_OUT,
+						Since:    now,
+					}
+					game.Incoming <- rpg.IncomingMessage{
+						PlayerId: c.User.Id,
+						Data: rpg.IncomingMessageData{
+							Type: rpg.ACTION_LINKDEAD,
+						},
+					}
+					log.Printf("[ws] %s went linkdead", c.User.Name)
+				} else {
+					playerLeft(c.User, c.State() == TIMED_OUT)
 				}
-				BroadcastToAllNoLock(ACTION_CHAT_MESSAGE, messageSend{
-					Content: fmt.Sprintf(message, c.User.Name),
-					From:    "server",
-					Class:   MESSAGE_CLASS_SERVER,
-				})
+			}
+		}
 
-				log.Printf("[ws] "+message, c.User.Name)
+		// linkdead players that didn't come back in time leave for real
+		for id, ld := range linkdeadClients {
+			if now-ld.Since > linkdeadTimeout {
+				delete(linkdeadClients, id)
+				playerLeft(ld.User, ld.TimedOut)
 			}
 		}
 
@@ -121,31 +206,135 @@ func ClientMaintenace() {
 	}
 }
 
+// playerLeft removes the player from the game, must be called with
+// clientsMutex held.
+func playerLeft(user User, timedOut bool) {
+	game.Incoming <- rpg.IncomingMessage{
+		PlayerId: user.Id,
+		Data: rpg.IncomingMessageData{
+			Type: rpg.ACTION_LEAVE,
+		},
+	}
+	message := "%s disconnected"
+	if timedOut {
+		message = "%s timed out"
+	}
+	BroadcastToAllNoLock(ACTION_CHAT_MESSAGE, messageSend{
+		Content: fmt.Sprintf(message, user.Name),
+		From:    "server",
+		Class:   MESSAGE_CLASS_SERVER,
+	})
+
+	log.Printf("[ws] "+message, user.Name)
+}
+
 func (c *Client) Write(data interface{}) {
-	if c.State < CLOSING {
-		outgoing <- outgoingMessage{Data: data, Dest: c}
+	if c.State() < CLOSING {
+		if !c.queue.Push(data) {
+			log.Printf("[ws/send] %s fell too far behind, disconnecting", c.Conn.RemoteAddr())
+			c.Disconnect()
+		}
 	}
 }
 
-func (c *Client) Authenticate(password string) error {
-	// check if user is already connected
-	// if client, exists := authenticatedClients[username]; exists {
-	// 	if err := client.Logout(); err != nil {
-	// 		log.Printf("[ws/auth] attempted to logout user but an error occurred (%v)", err)
-	// 	}
-	// }
+// Kick tells the client why it's being dropped, then closes the socket once
+// everything queued before it has been written.
+func (c *Client) Kick(reason ClientError) {
+	c.kicked.Store(true)
+	c.Close(reason, websocket.ClosePolicyViolation)
+}
+
+// Close is Kick with a choice of close code, for closes that aren't the
+// client's fault.
+func (c *Client) Close(reason ClientError, code int) {
+	c.Write(WSResponse{
+		Error:   reason.Code(),
+		Message: reason.ExternalMessage(),
+		Action:  ACTION_CLOSE,
+	})
+	if c.markClosing() {
+		c.queue.Push(closeMessage{
+			Code:   code,
+			Reason: reason.ExternalMessage(),
+		})
+	}
+}
+
+// Disconnect marks the client as closing and closes the socket, the read
+// loop in join() exits and ClientMaintenace cleans up the rest.
+func (c *Client) Disconnect() {
+	c.markClosing()
+	c.Conn.Close()
+}
 
-	user, err := AuthenticateUser(password)
+func (c *Client) Authenticate(claims TokenClaims) error {
+	user, err := LoadUser(claims.NameNormal)
 	if err != nil {
 		return err
 	}
+	if user.Id != claims.Subject {
+		return ErrorInvalidToken
+	}
+	if err := checkBanned(user); err != nil {
+		return err
+	}
+
+	// check if user is already connected
+	clientsMutex.Lock()
+	existing, exists := authenticatedClients[user.Id]
+	if exists && existing != c && duplicateLoginPolicy == DUPLICATE_LOGIN_REJECT_NEW {
+		clientsMutex.Unlock()
+		log.Printf("[ws/auth] rejected second login for %s", user.NameNormal)
+		return ErrorAlreadyLoggedIn
+	}
+	if exists && existing != c {
+		existing.Authenticated = false
+		existing.Kick(ErrorSessionReplaced)
+	}
 
 	c.User = user
+	c.Session = claims.Session
 	c.Authenticated = true
-	c.State = READY
+	c.setState(READY)
 
 	authenticatedClients[user.Id] = c
 
+	ld, linkdead := linkdeadClients[user.Id]
+	delete(linkdeadClients, user.Id)
+	clientsMutex.Unlock()
+
+	if linkdead && ld.Session == claims.Session {
+		log.Printf("[ws/auth] %s resumed their session", user.NameNormal)
+		game.Incoming <- rpg.IncomingMessage{
+			PlayerId: user.Id,
+			Data: rpg.IncomingMessageData{
+				Type: rpg.ACTION_RESUME,
+			},
+		}
+		return nil
+	}
+
+	// a new session replaces the linkdead one
+	if linkdead {
+		game.Incoming <- rpg.IncomingMessage{
+			PlayerId: user.Id,
+			Data: rpg.IncomingMessageData{
+				Type: rpg.ACTION_LEAVE,
+			},
+		}
+	}
+
+	if exists && existing != c {
+		log.Printf("[ws/auth] %s logged in again, kicked %s",
+			user.NameNormal, existing.Conn.RemoteAddr())
+		game.Incoming <- rpg.IncomingMessage{
+			PlayerId: user.Id,
+			Data: rpg.IncomingMessageData{
+				Type: rpg.ACTION_LEAVE,
+			},
+		}
+	}
+
 	game.Incoming <- rpg.IncomingMessage{
 		PlayerId: user.Id,
 		Data: rpg.IncomingMessageData{
@@ -162,3 +351,54 @@ func (c *Client) Authenticate(password string) error {
 
 	return nil
 }
+
+// SendGameState sends the client a delta against the last state it was
+// sent, or a full snapshot if there's nothing to diff against.
+func (c *Client) SendGameState(state rpg.DisplayData) {
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+
+	if c.queue.TakeResync() {
+		c.lastState = nil
+	}
+
+	if c.lastState == nil || !c.HasFeature(FEATURE_STATE_DELTA) ||
+		!rpg.CanDiff(*c.lastState, state) {
+		c.Write(WSResponse{
+			Error:  0,
+			Action: ACTION_GAME_STATE,
+			Data:   state,
+		})
+	} else {
+		delta, changed := rpg.DiffDisplayData(*c.lastState, state)
+		if !changed {
+			return
+		}
+		c.Write(WSResponse{
+			Error:  0,
+			Action: ACTION_GAME_STATE_DELTA,
+			Data:   delta,
+		})
+	}
+
+	c.lastState = &state
+
+	if state.Zone.Id != c.chatZone {
+		c.chatZone = state.Zone.Id
+		sendChatBacklog(c, CHAT_CHANNEL_SAY, c.chatZone)
+	}
+}
+
+// ChatZone returns the zone the client's say channel is in.
+func (c *Client) ChatZone() int {
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+	return c.chatZone
+}
+
+// Resync makes the next game state sent a full snapshot.
+func (c *Client) Resync() {
+	c.stateMutex.Lock()
+	c.lastState = nil
+	c.stateMutex.Unlock()
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+)
+
+// websocket subprotocols, picked by the client at upgrade time
+const (
+	PROTOCOL_JSON = "px.json"
+	PROTOCOL_CBOR = "px.cbor"
+)
+
+var wsSubprotocols = []string{PROTOCOL_JSON, PROTOCOL_CBOR}
+
+// Codec encodes WSResponses and decodes WSMessages for one wire format.
+// JSON stays the default since it's easy to read while debugging.
+type Codec interface {
+	Name() string
+	FrameType() int
+	Marshal(v interface{}) ([]byte, error)
+	DecodeMessage(frame []byte) (WSMessage, error)
+	// Unmarshal decodes a WSMessage's data, numbers always come out as
+	// float64 like they do with encoding/json
+	Unmarshal(data []byte, v interface{}) error
+}
+
+func CodecFor(subprotocol string) Codec {
+	switch subprotocol {
+	case PROTOCOL_CBOR:
+		return cborCodec{}
+	default:
+		return jsonCodec{}
+	}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return PROTOCOL_JSON
+}
+
+func (jsonCodec) FrameType() int {
+	return websocket.TextMessage
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// the data field of a JSON message is itself a JSON encoded string
+func (jsonCodec) DecodeMessage(frame []byte) (WSMessage, error) {
+	var msg WSMessage
+	err := json.Unmarshal(frame, &msg)
+	return msg, err
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type cborCodec struct{}
+
+// the data field of a CBOR message is embedded as is, not double encoded
+type cborMessage struct {
+	Id     string          `cbor:"id"`
+	Action ActionStr       `cbor:"action"`
+	Data   cbor.RawMessage `cbor:"data"`
+}
+
+var cborDecMode, _ = cbor.DecOptions{
+	DefaultMapType: reflect.TypeOf(map[string]interface{}{}),
+}.DecMode()
+
+func (cborCodec) Name() string {
+	return PROTOCOL_CBOR
+}
+
+func (cborCodec) FrameType() int {
+	return websocket.BinaryMessage
+}
+
+func (cborCodec) Marshal(v interface{}) ([]byte, error) {
+	return cbor.Marshal(v)
+}
+
+func (cborCodec) DecodeMessage(frame []byte) (WSMessage, error) {
+	var msg cborMessage
+	if err := cborDecMode.Unmarshal(frame, &msg); err != nil {
+		return WSMessage{}, err
+	}
+	return WSMessage{Id: msg.Id, Action: msg.Action, Data: string(msg.Data)}, nil
+}
+
+// Unmarshal goes through encoding/json so handlers (and the rpg action
+// params) see exactly the same types whichever codec the client uses.
+// Incoming messages are small, so the extra pass doesn't matter.
+func (cborCodec) Unmarshal(data []byte, v interface{}) error {
+	var generic interface{}
+	if err := cborDecMode.Unmarshal(data, &generic); err != nil {
+		return err
+	}
+	normalized, err := json.Marshal(generic)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(normalized, v)
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/jdaiv/px-server/rpg"
+)
+
+// Commands work on the storage directly, the running server keeps its own copy
+// of players and zones and will overwrite changes to them when it next
+// saves, so stop it before using anything that writes game data. With file
+// storage that goes for users too, the server rewrites the whole file
+// whenever it saves. Memory storage only lives as long as the process, so
+// commands refuse to run against it.
+type command struct {
+	usage string
+	args  int
+	run   func(args []string) error
+}
+
+var commands = map[string]map[string]command{
+	"user": {
+		"create":         {"<name> [superuser]", 1, cmdUserCreate},
+		"promote":        {"<name>", 1, cmdUserPromote},
+		"demote":         {"<name>", 1, cmdUserDemote},
+		"reset-password": {"<name>", 1, cmdUserResetPassword},
+	},
+	"zone": {
+		"dump":    {"<id> [file]", 1, cmdZoneDump},
+		"restore": {"<id> <file>", 2, cmdZoneRestore},
+	},
+	"player": {
+		"unstuck": {"<name>", 1, cmdPlayerUnstuck},
+		"items":   {"<name>", 1, cmdPlayerItems},
+	},
+	"db": {
+		"migrate":           {"", 0, cmdMigrate},
+		"version":           {"", 0, cmdSchemaVersion},
+		"migrate-passwords": {"", 0, cmdMigratePasswords},
+	},
+}
+
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [flags] [command]\n\ncommands:\n", os.Args[0])
+	groups := make([]string, 0, len(commands))
+	for group := range commands {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	for _, group := range groups {
+		names := make([]string, 0, len(commands[group]))
+		for name := range commands[group] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(os.Stderr, "  %s %s %s\n", group, name, commands[group][name].usage)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "\nwith no command, runs the server. Commands that change data should only be\n"+
+		"run while the server is stopped, with file storage it overwrites them when it next saves.\n\nflags:\n")
+	flag.PrintDefaults()
+}
+
+// runCommand runs a command line subcommand and returns the exit code.
+func runCommand(args []string) int {
+	if len(args) < 2 {
+		printUsage()
+		return 2
+	}
+	cmd, ok := commands[args[0]][args[1]]
+	if !ok || len(args)-2 < cmd.args {
+		printUsage()
+		return 2
+	}
+	if storage == STORAGE_MEMORY {
+		fmt.Fprintf(os.Stderr, "%s %s: nothing is kept with memory storage, use postgres or file\n", args[0], args[1])
+		return 1
+	}
+	if err := cmd.run(args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s %s: %v\n", args[0], args[1], err)
+		return 1
+	}
+	return 0
+}
+
+func cmdUserCreate(args []string) error {
+	if err := ValidateUsername(args[0]); err != nil {
+		return err
+	}
+	user, password, err := CreateUser(args[0])
+	if err != nil {
+		return err
+	}
+	if len(args) > 1 && args[1] == "superuser" {
+		if err := SetSuperUser(user.Id, true); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("created %s (id %d), password: %s\n", user.Name, user.Id, password)
+	return nil
+}
+
+func cmdUserPromote(args []string) error {
+	return setSuperUserByName(args[0], true)
+}
+
+func cmdUserDemote(args []string) error {
+	return setSuperUserByName(args[0], false)
+}
+
+func setSuperUserByName(name string, superUser bool) error {
+	user, err := LoadUser(normalizeUsername(name))
+	if err != nil {
+		return err
+	}
+	if err := SetSuperUser(user.Id, superUser); err != nil {
+		return err
+	}
+	fmt.Printf("%s superuser: %v\n", user.Name, superUser)
+	return nil
+}
+
+func cmdUserResetPassword(args []string) error {
+	user, err := LoadUser(normalizeUsername(args[0]))
+	if err != nil {
+		return err
+	}
+	password := createPassword()
+	if err := setPasswordHash(user.Id, password); err != nil {
+		return err
+	}
+	// tokens already issued stay valid until they expire, kick the user
+	// through the admin API if that matters
+	fmt.Printf("new password for %s: %s\n", user.Name, password)
+	return nil
+}
+
+func parseId(s string) (int, error) {
+	var id int
+	if _, err := fmt.Sscan(s, &id); err != nil {
+		return 0, fmt.Errorf("invalid id %q", s)
+	}
+	return id, nil
+}
+
+func cmdZoneDump(args []string) error {
+	id, err := parseId(args[0])
+	if err != nil {
+		return err
+	}
+
+	zones, err := gameStore.LoadZones()
+	if err != nil {
+		return err
+	}
+	zone, ok := zones[id]
+	if !ok {
+		return fmt.Errorf("zone %d doesn't exist", id)
+	}
+
+	data, err := json.MarshalIndent(zone, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if len(args) > 1 && args[1] != "-" {
+		return ioutil.WriteFile(args[1], data, 0644)
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+func cmdZoneRestore(args []string) error {
+	id, err := parseId(args[0])
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	if args[1] == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(args[1])
+	}
+	if err != nil {
+		return err
+	}
+
+	// round trip through the zone type so a broken file doesn't make it
+	// into the DB
+	var zone rpg.Zone
+	if err := json.Unmarshal(data, &zone); err != nil {
+		return fmt.Errorf("invalid zone data: %v", err)
+	}
+	zone.Id = id
+
+	zones, err := gameStore.LoadZones()
+	if err != nil {
+		return err
+	}
+	if _, ok := zones[id]; !ok {
+		return fmt.Errorf("zone %d doesn't exist", id)
+	}
+	row, err := rpg.NewRow(id, zone)
+	if err != nil {
+		return err
+	}
+	if err := gameStore.Commit(rpg.Batch{Zones: []rpg.Row{row}}); err != nil {
+		return err
+	}
+	fmt.Printf("restored zone %d (%s)\n", id, zone.Name)
+	return nil
+}
+
+func loadPlayer(name string) (User, *rpg.Player, error) {
+	user, err := LoadUser(normalizeUsername(name))
+	if err != nil {
+		return user, nil, err
+	}
+	players, err := gameStore.LoadPlayers()
+	if err != nil {
+		return user, nil, err
+	}
+	player, ok := players[user.Id]
+	if !ok {
+		// never joined, the game makes a fresh player the same way
+		player = &rpg.Player{Id: user.Id}
+	}
+	return user, player, nil
+}
+
+func cmdPlayerUnstuck(args []string) error {
+	user, player, err := loadPlayer(args[0])
+	if err != nil {
+		return err
+	}
+
+	from := player.CurrentZone
+	// same spot PlayerReset respawns players at
+	player.CurrentZone = 1
+	player.X = -1
+	player.Y = -1
+
+	row, err := rpg.NewRow(user.Id, player)
+	if err != nil {
+		return err
+	}
+	if err := gameStore.Commit(rpg.Batch{Players: []rpg.Row{row}}); err != nil {
+		return err
+	}
+	fmt.Printf("moved %s from zone %d to zone 1\n", user.Name, from)
+	return nil
+}
+
+func cmdPlayerItems(args []string) error {
+	user, _, err := loadPlayer(args[0])
+	if err != nil {
+		return err
+	}
+
+	items, err := gameStore.LoadItems()
+	if err != nil {
+		return err
+	}
+
+	held := make([]rpg.Item, 0)
+	for _, item := range items {
+		if item.Held && item.HeldBy == user.Id {
+			held = append(held, item)
+		}
+	}
+	sort.Slice(held, func(i, j int) bool { return held[i].Id < held[j].Id })
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tTYPE\tQUALITY\tDURABILITY\tEQUIPPED")
+	for _, item := range held {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%d\t%s\n",
+			item.Id, item.Name, item.Type, item.Quality, item.Durability, item.Equipped)
+	}
+	return w.Flush()
+}
+
+func cmdMigrate(args []string) error {
+	if !hasDB() {
+		return ErrorNoDatabase
+	}
+	applied, err := Migrate()
+	if err != nil {
+		return err
+	}
+	version, err := SchemaVersion()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("applied %d migrations, schema at version %d\n", applied, version)
+	return nil
+}
+
+func cmdSchemaVersion(args []string) error {
+	if !hasDB() {
+		return ErrorNoDatabase
+	}
+	version, err := SchemaVersion()
+	if err != nil {
+		return err
+	}
+	latest := latestSchemaVersion()
+	fmt.Printf("schema at version %d, this server knows up to %d\n", version, latest)
+	if version > latest {
+		fmt.Println("the schema is newer than this server, upgrade it before starting")
+	}
+	return nil
+}
+
+func cmdMigratePasswords(args []string) error {
+	migrated, err := MigratePasswords()
+	if err != nil {
+		return fmt.Errorf("failed after %d rows: %v", migrated, err)
+	}
+	fmt.Printf("hashed %d plaintext passwords\n", migrated)
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	DEFAULT_MAX_CONNECTIONS        = 1000
+	DEFAULT_MAX_CONNECTIONS_PER_IP = 8
+	DEFAULT_MAX_MESSAGE_SIZE       = 64 * 1024
+)
+
+// dev mode allows any origin and turns the connection limits off
+var devMode = false
+var allowedOrigins = make(map[string]bool)
+var maxConnections = DEFAULT_MAX_CONNECTIONS
+var maxConnectionsPerIP = DEFAULT_MAX_CONNECTIONS_PER_IP
+var maxMessageSize int64 = DEFAULT_MAX_MESSAGE_SIZE
+
+var connectionsMutex = &sync.Mutex{}
+var totalConnections = 0
+var connectionsPerIP = make(map[string]int)
+
+func SetAllowedOrigins(origins []string) {
+	for _, o := range origins {
+		allowedOrigins[strings.ToLower(strings.TrimSuffix(o, "/"))] = true
+	}
+}
+
+func originAllowed(origin string) bool {
+	return allowedOrigins[strings.ToLower(strings.TrimSuffix(origin, "/"))]
+}
+
+// checkOrigin is used by the websocket upgrader. Requests without an Origin
+// header don't come from a browser, so they're let through.
+func checkOrigin(r *http.Request) bool {
+	if devMode {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	return originAllowed(origin)
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// acquireConnection reserves a connection slot for ip, releaseConnection
+// has to be called once the connection closes.
+func acquireConnection(ip string) bool {
+	connectionsMutex.Lock()
+	defer connectionsMutex.Unlock()
+
+	if !devMode {
+		if maxConnections > 0 && totalConnections >= maxConnections {
+			return false
+		}
+		if maxConnectionsPerIP > 0 && connectionsPerIP[ip] >= maxConnectionsPerIP {
+			return false
+		}
+	}
+
+	totalConnections += 1
+	connectionsPerIP[ip] += 1
+	return true
+}
+
+func releaseConnection(ip string) {
+	connectionsMutex.Lock()
+	defer connectionsMutex.Unlock()
+
+	totalConnections -= 1
+	connectionsPerIP[ip] -= 1
+	if connectionsPerIP[ip] <= 0 {
+		delete(connectionsPerIP, ip)
+	}
+}
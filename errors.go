@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+
+	"github.com/jdaiv/px-server/rpg"
 )
 
 var (
@@ -14,6 +16,18 @@ var (
 		"ws: missing action", "missing action")
 	ErrorMissingScope = NewClientError(1002,
 		"ws: missing scope", "missing scope")
+	ErrorProtocolTooOld = NewClientError(1003,
+		"ws: client protocol version too old", "your client is out of date, please refresh")
+	ErrorHelloRequired = NewClientError(1004,
+		"ws: hello required before login", "your client is out of date, please refresh")
+	ErrorRateLimited = NewClientError(1005,
+		"ws: rate limited", "slow down!")
+	ErrorFlooding = NewClientError(1006,
+		"ws: disconnected for flooding", "disconnected for sending too many messages")
+	ErrorShuttingDown = NewClientError(1007,
+		"ws: server shutting down", "the server is shutting down, try again in a bit")
+	ErrorNoDatabase = NewClientError(1008,
+		"server: needs a database", "not available on this server")
 
 	ErrorInvalidLogin = NewClientError(3001,
 		"auth: invalid login", "invalid username and password combination")
@@ -36,6 +50,18 @@ var (
 		"ws_auth: invalid token", "invalid token")
 	ErrorUnauthenticated = NewClientError(3102,
 		"ws_auth: unauthenticated", "unauthenticated")
+	ErrorTokenExpired = NewClientError(3301,
+		"auth: token expired", "session expired, please log in again")
+	ErrorSessionReplaced = NewClientError(3302,
+		"ws_auth: session replaced by a newer login", "you logged in from somewhere else")
+	ErrorAlreadyLoggedIn = NewClientError(3303,
+		"ws_auth: user already connected", "you're already logged in somewhere else")
+	ErrorBanned = NewClientError(3304,
+		"auth: user is banned", "you have been banned")
+	ErrorKicked = NewClientError(3305,
+		"ws_auth: kicked by an admin", "you were kicked from the server")
+	ErrorForbidden = NewClientError(3306,
+		"auth: superuser required", "you don't have permission to do that")
 
 	ErrorRoomExists = NewClientError(2001,
 		"rooms: room already exists", "room already exists")
@@ -56,8 +82,62 @@ var (
 		"activities: invalid action", "invalid action")
 	ErrorActError = NewClientError(4003,
 		"activities: encountered an error", "activity encountered an error")
+
+	ErrorNotYourTurn = NewClientError(5001,
+		"rpg: not your turn", "it's not your turn")
+	ErrorOutOfRange = NewClientError(5002,
+		"rpg: out of range", "that's too far away")
+	ErrorNotEnoughAP = NewClientError(5003,
+		"rpg: not enough AP", "not enough AP")
+	ErrorUnknownItem = NewClientError(5004,
+		"rpg: unknown item", "you can't do that with that item")
+	ErrorUnknownTarget = NewClientError(5005,
+		"rpg: unknown target", "there's nothing there")
+	ErrorInvalidParams = NewClientError(5006,
+		"rpg: invalid action parameters", "invalid action")
+	ErrorBlocked = NewClientError(5007,
+		"rpg: blocked", "something's in the way")
+	ErrorActionFailed = NewClientError(5008,
+		"rpg: action failed", "that didn't work")
+	ErrorSavingBehind = NewClientError(5009,
+		"rpg: saving fell behind", "the server's having trouble saving, try again in a bit")
+	ErrorInvalidEditParam = NewClientError(5101,
+		"rpg: invalid edit parameter", "invalid edit parameter")
+	ErrorNotEditing = NewClientError(5102,
+		"rpg: not in edit mode", "enable editing first")
+
+	ErrorUnknownCommand = NewClientError(6001,
+		"chat: unknown command", "unknown command, try /help")
+	ErrorMuted = NewClientError(6002,
+		"chat: user muted", "you've been muted")
+	ErrorMessageBlocked = NewClientError(6003,
+		"chat: message blocked by filter", "your message wasn't sent, mind your language")
 )
 
+var rpgErrors = map[error]ClientError{
+	rpg.ErrNotYourTurn:      ErrorNotYourTurn,
+	rpg.ErrOutOfRange:       ErrorOutOfRange,
+	rpg.ErrNotEnoughAP:      ErrorNotEnoughAP,
+	rpg.ErrUnknownItem:      ErrorUnknownItem,
+	rpg.ErrUnknownTarget:    ErrorUnknownTarget,
+	rpg.ErrInvalidParams:    ErrorInvalidParams,
+	rpg.ErrBlocked:          ErrorBlocked,
+	rpg.ErrActionFailed:     ErrorActionFailed,
+	rpg.ErrInvalidEditParam: ErrorInvalidEditParam,
+	rpg.ErrNotEditing:       ErrorNotEditing,
+	rpg.ErrShuttingDown:     ErrorShuttingDown,
+	rpg.ErrSavingBehind:     ErrorSavingBehind,
+}
+
+// RPGClientError converts an error from the rpg package into the
+// ClientError sent over the websocket.
+func RPGClientError(err error) ClientError {
+	if cErr, ok := rpgErrors[err]; ok {
+		return cErr
+	}
+	return ErrorInternal
+}
+
 type ClientError interface {
 	error
 	Code() int
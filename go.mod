@@ -1,12 +1,20 @@
 module github.com/jdaiv/px-server
 
+go 1.20
+
 require (
 	github.com/BurntSushi/toml v0.3.1
-	github.com/gorilla/context v1.1.1 // indirect
+	github.com/fxamacker/cbor/v2 v2.9.2
 	github.com/gorilla/handlers v1.4.0
 	github.com/gorilla/mux v1.6.2
 	github.com/gorilla/websocket v1.3.0
 	github.com/lib/pq v1.0.0
 	github.com/sethvargo/go-password v0.1.2
-	golang.org/x/text v0.3.0
+	golang.org/x/crypto v0.9.0
+	golang.org/x/text v0.9.0
+)
+
+require (
+	github.com/gorilla/context v1.1.1 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
 )
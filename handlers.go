@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
 	"time"
@@ -12,21 +11,45 @@ type ActionStr string
 const (
 	ACTION_CLOSE            = "close"
 	ACTION_PING             = "ping"
+	ACTION_HELLO            = "hello"
 	ACTION_LOGIN            = "login"
 	ACTION_CREATE_USER      = "create_user"
+	ACTION_REFRESH_TOKEN    = "refresh_token"
+	ACTION_REVOKE_TOKEN     = "revoke_token"
 	ACTION_CHAT_MESSAGE     = "chat_message"
+	ACTION_CHAT_HISTORY     = "chat_history"
 	ACTION_LIST_USERS       = "list_users"
+	ACTION_RATE_LIMITS      = "rate_limits"
+	ACTION_MODERATION_LOG   = "moderation_log"
 	ACTION_GAME_STATE       = "game_state"
+	ACTION_GAME_STATE_DELTA = "game_state_delta"
+	ACTION_GAME_RESYNC      = "game_resync"
 	ACTION_GAME_ACTION      = "game_action"
 	ACTION_GAME_EDIT_ACTION = "game_edit"
+
+	ACTION_ADMIN_CLIENTS   = "admin_clients"
+	ACTION_ADMIN_KICK      = "admin_kick"
+	ACTION_ADMIN_BAN       = "admin_ban"
+	ACTION_ADMIN_UNBAN     = "admin_unban"
+	ACTION_ADMIN_MUTE      = "admin_mute"
+	ACTION_ADMIN_UNMUTE    = "admin_unmute"
+	ACTION_ADMIN_BROADCAST = "admin_broadcast"
+	ACTION_ADMIN_SAVE      = "admin_save"
+	ACTION_ADMIN_TELEPORT  = "admin_teleport"
+	ACTION_ADMIN_SUPERUSER = "admin_superuser"
+	// superuser chat commands
+	ACTION_ADMIN_COMMAND = "admin_command"
 )
 
 type WSMessage struct {
+	// optional, echoed back in the response so clients can match them up
+	Id     string    `json:"id,omitempty"`
 	Action ActionStr `json:"action"`
 	Data   string    `json:"data"`
 }
 
 type WSResponse struct {
+	Id      string      `json:"id,omitempty"`
 	Error   int         `json:"error"`
 	Message string      `json:"message"`
 	Action  ActionStr   `json:"action"`
@@ -38,25 +61,35 @@ type incomingAction struct {
 	Source *Client
 }
 
-var incoming = make(chan incomingAction)
+// buffered so the queue depth can be measured, a full buffer means the
+// handlers aren't keeping up
+const INCOMING_QUEUE_SIZE = 64
+
+var incoming = make(chan incomingAction, INCOMING_QUEUE_SIZE)
 
-type WSHandler func(source *Client, data []byte) (interface{}, error)
+type WSHandler func(source *Client, requestId string, data []byte) (interface{}, error)
 
 var wsRouter = map[ActionStr]WSHandler{
 	ACTION_PING:  pingHandler,
+	ACTION_HELLO: helloHandler,
 	ACTION_LOGIN: loginHandler,
 	// "logout":       logoutHandler,
 
 	ACTION_CHAT_MESSAGE: handleChatMessage,
+	ACTION_CHAT_HISTORY: handleChatHistory,
 	ACTION_LIST_USERS:   handleListUsers,
+	ACTION_RATE_LIMITS:  handleRateLimits,
+
+	ACTION_MODERATION_LOG: handleModerationLog,
 
 	// ACTION_GAME_STATE:       handleGameState,
+	ACTION_GAME_RESYNC:      handleGameResync,
 	ACTION_GAME_ACTION:      handleGameAction,
 	ACTION_GAME_EDIT_ACTION: handleGameEditAction,
 }
 
-func parseIncoming(data []byte, v interface{}) error {
-	err := json.Unmarshal([]byte(data), v)
+func parseIncoming(source *Client, data []byte, v interface{}) error {
+	err := source.codec.Unmarshal(data, v)
 	if err != nil {
 		// log.Printf("[server] error: %v", err)
 		return fmt.Errorf("json payload: invalid data")
@@ -75,40 +108,50 @@ func incomingMessages() {
 			log.Printf("[ws/%s] handler not found", in.Msg.Action)
 			err = ErrorMissingAction
 		} else {
-			response, err = handler(in.Source, []byte(in.Msg.Data))
+			response, err = handler(in.Source, in.Msg.Id, []byte(in.Msg.Data))
 		}
 
 		if err != nil {
-			cErr, ok := err.(ClientError)
-			if !ok {
-				log.Printf("[ws/send] uncaught error: %v", err)
-				cErr = ErrorInternal
-			}
-			log.Printf("[ws/send] error: %v", cErr)
-			in.Source.Write(WSResponse{
-				Error:   cErr.Code(),
-				Message: cErr.ExternalMessage(),
-				Action:  in.Msg.Action,
-				Data:    nil,
-			})
+			writeError(in.Source, in.Msg.Id, in.Msg.Action, err)
 		}
 
 		if response != nil {
 			wsRespsonse, ok := response.(WSResponse)
 			if !ok {
 				wsRespsonse = WSResponse{
+					Id:      in.Msg.Id,
 					Error:   0,
 					Message: "success",
 					Action:  in.Msg.Action,
 					Data:    response,
 				}
+			} else if wsRespsonse.Id == "" {
+				wsRespsonse.Id = in.Msg.Id
 			}
 			in.Source.Write(wsRespsonse)
 		}
 	}
 }
 
-func pingHandler(source *Client, data []byte) (interface{}, error) {
+// writeError sends err back as the response to a request, anything that
+// isn't a ClientError goes out as an internal error.
+func writeError(source *Client, requestId string, action ActionStr, err error) {
+	cErr, ok := err.(ClientError)
+	if !ok {
+		log.Printf("[ws/send] uncaught error: %v", err)
+		cErr = ErrorInternal
+	}
+	log.Printf("[ws/send] error: %v", cErr)
+	source.Write(WSResponse{
+		Id:      requestId,
+		Error:   cErr.Code(),
+		Message: cErr.ExternalMessage(),
+		Action:  action,
+		Data:    nil,
+	})
+}
+
+func pingHandler(source *Client, requestId string, data []byte) (interface{}, error) {
 	// log.Printf("[ws/ping] hello %s", source.Conn.RemoteAddr())
 	now := time.Now().UnixNano()
 	source.LastPing = now
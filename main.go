@@ -1,7 +1,6 @@
 package main
 
 import (
-	"context"
 	"database/sql"
 	"flag"
 	"log"
@@ -10,6 +9,7 @@ import (
 	"os"
 	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/jdaiv/px-server/rpg"
@@ -25,18 +25,78 @@ var JWTSecret []byte
 
 var DB *sql.DB
 
+const DEFAULT_AUTOSAVE_INTERVAL = 60 * time.Second
+
+var autosaveInterval = DEFAULT_AUTOSAVE_INTERVAL
+
 type Config struct {
 	Addr      string
 	DBConnStr string
 	JWTSecret string
+
+	// postgres (the default), memory or file, only postgres supports
+	// moderation and the chat and audit logs. Commands can't be used with
+	// memory, and with file only while the server's stopped
+	Storage string
+	// directory the file backend keeps its data in
+	StoragePath string
+	// don't migrate the DB at startup, the db migrate command has to be
+	// run first instead
+	SkipMigrations bool
+	// everything's saved this often even if nothing's marked it as changed,
+	// -1 turns autosave off
+	AutosaveSeconds int
+	// changes are written here before the store so they can be recovered
+	// after a crash, defaults to journal.jsonl, in StoragePath for the file
+	// backend
+	JournalPath string
+	NoJournal   bool
+
+	// allows any origin and disables connection limits, for local dev
+	DevMode             bool
+	AllowedOrigins      []string
+	MaxConnections      int
+	MaxConnectionsPerIP int
+	MaxMessageSize      int64
+
+	// in seconds
+	AccessTokenLifetime  int
+	RefreshTokenLifetime int
+
+	OutgoingQueueSize   int
+	OutgoingQueuePolicy string
+
+	DuplicateLoginPolicy string
+	// per action class: chat, game, edit and other
+	RateLimits map[string]RateLimit
+	// rate limited messages in a row before a client is disconnected
+	RateLimitStrikes int
+
+	// clients older than this are turned away at hello
+	MinProtocolVersion int
+
+	// how long a dropped player stays in the world waiting to reconnect,
+	// -1 removes them straight away
+	LinkdeadSeconds int
+
+	// seconds of warning players get before a shutdown, -1 shuts down
+	// straight away
+	ShutdownCountdown int
+
+	// messages kept per chat channel for scrollback, -1 turns history off
+	ChatHistorySize int
+	// also write chat to the chat_log table, so history survives restarts
+	ChatLog bool
 }
 
 var configLocation = flag.String("config", "config.toml", "location of config file")
 var resLocation = flag.String("res", "resources", "location of static resources")
+var migratePasswords = flag.Bool("migrate-passwords", false, "same as the db migrate-passwords command")
 
 var game *rpg.RPG
 
 func main() {
+	flag.Usage = printUsage
 	flag.Parse()
 
 	config := Config{}
@@ -46,120 +106,170 @@ func main() {
 	}
 
 	JWTSecret = []byte(config.JWTSecret)
+	if len(JWTSecret) == 0 {
+		log.Printf("[server] JWTSecret must be set")
+		os.Exit(1)
+	}
+	if config.AccessTokenLifetime > 0 {
+		accessTokenLifetime = time.Duration(config.AccessTokenLifetime) * time.Second
+	}
+	if config.RefreshTokenLifetime > 0 {
+		refreshTokenLifetime = time.Duration(config.RefreshTokenLifetime) * time.Second
+	}
+
+	devMode = config.DevMode
+	SetAllowedOrigins(config.AllowedOrigins)
+	if config.MaxConnections > 0 {
+		maxConnections = config.MaxConnections
+	}
+	if config.MaxConnectionsPerIP > 0 {
+		maxConnectionsPerIP = config.MaxConnectionsPerIP
+	}
+	if config.MaxMessageSize > 0 {
+		maxMessageSize = config.MaxMessageSize
+	}
+	if devMode {
+		log.Printf("[server] dev mode, allowing all origins")
+	} else if len(config.AllowedOrigins) == 0 {
+		log.Printf("[server] no AllowedOrigins set, browsers won't be able to connect")
+	}
+
+	if config.OutgoingQueueSize > 0 {
+		queueSize = config.OutgoingQueueSize
+	}
+	if config.OutgoingQueuePolicy != "" {
+		if !ValidQueuePolicy(config.OutgoingQueuePolicy) {
+			log.Printf("[server] invalid outgoing queue policy: %s", config.OutgoingQueuePolicy)
+			os.Exit(1)
+		}
+		queuePolicy = config.OutgoingQueuePolicy
+	}
+	if config.DuplicateLoginPolicy != "" {
+		if !ValidDuplicateLoginPolicy(config.DuplicateLoginPolicy) {
+			log.Printf("[server] invalid duplicate login policy: %s", config.DuplicateLoginPolicy)
+			os.Exit(1)
+		}
+		duplicateLoginPolicy = config.DuplicateLoginPolicy
+	}
+	for class, limit := range config.RateLimits {
+		if _, ok := rateLimits[class]; !ok || limit.Rate <= 0 || limit.Burst <= 0 {
+			log.Printf("[server] invalid rate limit for %s: %v", class, limit)
+			os.Exit(1)
+		}
+		rateLimits[class] = limit
+	}
+	if config.RateLimitStrikes > 0 {
+		rateLimitStrikes = config.RateLimitStrikes
+	}
+	if config.MinProtocolVersion > 0 {
+		minProtocolVersion = config.MinProtocolVersion
+	}
+	if config.LinkdeadSeconds != 0 {
+		linkdeadTimeout = int64(config.LinkdeadSeconds) * 1e+9
+	}
+	if config.ShutdownCountdown != 0 {
+		shutdownCountdown = config.ShutdownCountdown
+	}
+	if config.Storage == "" {
+		config.Storage = STORAGE_POSTGRES
+	}
+	if !ValidStorage(config.Storage) {
+		log.Printf("[server] invalid storage: %s", config.Storage)
+		os.Exit(1)
+	}
+	if config.ChatHistorySize != 0 {
+		chatHistorySize = config.ChatHistorySize
+	}
+	if config.AutosaveSeconds != 0 {
+		autosaveInterval = time.Duration(config.AutosaveSeconds) * time.Second
+	}
+	persistChat = config.ChatLog && chatHistorySize > 0 && config.Storage == STORAGE_POSTGRES
 
 	rand.Seed(time.Now().UTC().UnixNano())
 
 	r := mux.NewRouter()
 	r.Use(middleware.RecoveryHandler())
-	r.Use(middleware.CORS())
+	if devMode {
+		r.Use(middleware.CORS())
+	} else {
+		r.Use(middleware.CORS(middleware.AllowedOriginValidator(originAllowed)))
+	}
 	r.HandleFunc("/api/ws", join).Methods("GET")
 	r.HandleFunc("/api/auth/login", login).Methods("POST")
 	r.HandleFunc("/api/auth/create", createUser).Methods("POST")
+	r.HandleFunc("/api/auth/refresh", refreshToken).Methods("POST")
+	r.HandleFunc("/api/auth/revoke", revokeToken).Methods("POST")
+	r.HandleFunc("/healthz", healthz).Methods("GET")
+	r.HandleFunc("/readyz", readyz).Methods("GET")
+	r.HandleFunc("/metrics", metrics).Methods("GET")
 
-	var err error
-	DB, err = sql.Open("postgres", config.DBConnStr)
-	if err != nil {
-		log.Fatal(err)
+	admin := r.PathPrefix("/api/admin").Subrouter()
+	admin.HandleFunc("/clients", requireAdmin(ACTION_ADMIN_CLIENTS, adminClients)).Methods("GET")
+	admin.HandleFunc("/kick", requireAdmin(ACTION_ADMIN_KICK, adminKick)).Methods("POST")
+	admin.HandleFunc("/ban", requireAdmin(ACTION_ADMIN_BAN, adminBan)).Methods("POST")
+	admin.HandleFunc("/unban", requireAdmin(ACTION_ADMIN_UNBAN, adminUnban)).Methods("POST")
+	admin.HandleFunc("/mute", requireAdmin(ACTION_ADMIN_MUTE, adminMute)).Methods("POST")
+	admin.HandleFunc("/unmute", requireAdmin(ACTION_ADMIN_UNMUTE, adminUnmute)).Methods("POST")
+	admin.HandleFunc("/moderation", requireAdmin(ACTION_MODERATION_LOG, adminModerationLog)).Methods("GET")
+	admin.HandleFunc("/broadcast", requireAdmin(ACTION_ADMIN_BROADCAST, adminBroadcast)).Methods("POST")
+	admin.HandleFunc("/save", requireAdmin(ACTION_ADMIN_SAVE, adminSave)).Methods("POST")
+	admin.HandleFunc("/teleport", requireAdmin(ACTION_ADMIN_TELEPORT, adminTeleport)).Methods("POST")
+	admin.HandleFunc("/superuser", requireAdmin(ACTION_ADMIN_SUPERUSER, adminSuperUser)).Methods("POST")
+
+	if err := OpenStorage(config); err != nil {
+		log.Fatalf("[server] error opening storage: %v", err)
+	}
+
+	if *migratePasswords {
+		os.Exit(runCommand([]string{"db", "migrate-passwords"}))
+	}
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Args()))
 	}
 
-	log.Println("[server] connected to DB")
+	if hasDB() {
+		if err := startupMigrate(config.SkipMigrations); err != nil {
+			log.Fatalf("[server] %v", err)
+		}
+	}
 
 	resPath := *resLocation
 	if !strings.HasSuffix(resPath, "/") {
 		resPath += "/"
 	}
-	game, err = rpg.NewRPG(resPath, DB)
+	if err := LoadChatFilter(resPath); err != nil {
+		log.Fatalf("[server] error loading chat filter: %v", err)
+	}
+	if err := LoadChatHistory(); err != nil {
+		log.Fatalf("[server] error loading chat history: %v", err)
+	}
+
+	// has to happen before the game loads, so it sees the recovered rows
+	journal, err := OpenJournal(config)
+	if err != nil {
+		log.Fatalf("[server] %v", err)
+	}
+	game, err = rpg.NewRPG(resPath, gameStore, journal)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if autosaveInterval > 0 {
+		game.AutosaveInterval = autosaveInterval
+	}
 
 	log.Println("[server] made game")
 
 	go ClientMaintenace()
 	go incomingMessages()
-	go outgoingMessages()
 	go game.HandleMessages()
 
-	go func() {
-		for {
-			outgoing := <-game.Outgoing
-			zone, ok := game.Zones.Get(outgoing.Zone)
-			if !ok {
-				continue
-			}
-
-			switch outgoing.Type {
-			case rpg.ACTION_UPDATE:
-				game.BuildDisplayData(zone)
-				clientsMutex.Lock()
-				for id := range zone.Players {
-					authenticatedClients[id].Write(WSResponse{
-						Error:  0,
-						Action: ACTION_GAME_STATE,
-						Data:   game.BuildDisplayFor(id),
-					})
-				}
-				clientsMutex.Unlock()
-			case rpg.ACTION_CHAT:
-				message, ok := outgoing.Params["message"]
-				if !ok {
-					continue
-				}
-				messageStr, ok := message.(string)
-				if !ok {
-					continue
-				}
-				if outgoing.PlayerId >= 0 {
-					client, ok := authenticatedClients[outgoing.PlayerId]
-					if !ok {
-						continue
-					}
-					client.Write(WSResponse{
-						Error:  0,
-						Action: ACTION_CHAT_MESSAGE,
-						Data: messageSend{
-							Content: messageStr,
-							From:    "server",
-							Class:   MESSAGE_CLASS_SERVER,
-						},
-					})
-				} else {
-					clientsMutex.Lock()
-					for id := range zone.Players {
-						authenticatedClients[id].Write(WSResponse{
-							Error:  0,
-							Action: ACTION_CHAT_MESSAGE,
-							Data: messageSend{
-								Content: messageStr,
-								From:    "server",
-								Class:   MESSAGE_CLASS_SERVER,
-							},
-						})
-					}
-					clientsMutex.Unlock()
-				}
-			default:
-				clientsMutex.Lock()
-				for id := range zone.Players {
-					authenticatedClients[id].Write(WSResponse{
-						Error:  0,
-						Action: ActionStr(outgoing.Type),
-						Data:   outgoing.Params,
-					})
-				}
-				clientsMutex.Unlock()
-			}
-		}
-	}()
+	go outgoingGameMessages()
+	if persistChat {
+		go writeChatLog()
+	}
 
-	go func() {
-		for {
-			game.Incoming <- rpg.IncomingMessage{
-				Data: rpg.IncomingMessageData{Type: rpg.ACTION_TICK},
-			}
-			time.Sleep(125 * time.Millisecond)
-		}
-	}()
+	stopTicker := make(chan bool)
+	go tickGame(stopTicker)
 
 	srv := &http.Server{
 		Addr:         config.Addr,
@@ -177,23 +287,10 @@ func main() {
 		}
 	}()
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
 
-	<-c
-
-	game.SaveAll()
-
-	// Create a deadline to wait for.
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
-	defer cancel()
-	// Doesn't block if no connections, but will otherwise wait
-	// until the timeout deadline.
-	srv.Shutdown(ctx)
-	// Optionally, you could run srv.Shutdown in a goroutine and block on
-	// <-ctx.Done() if your application should wait for other services
-	// to finalize based on context cancellation.
-	log.Println("[server] shutting down")
+	<-signals
+	shutdown(srv, stopTicker, signals)
 	os.Exit(0)
-
 }
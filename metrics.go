@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jdaiv/px-server/rpg"
+)
+
+// the game loop ticks every 125ms, if it hasn't for this long it's stuck
+const MAX_TICK_AGE = 2 * time.Second
+
+func healthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+type readyCheck struct {
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+func readyz(w http.ResponseWriter, r *http.Request) {
+	checks := make(map[string]readyCheck)
+	ready := true
+
+	if isShuttingDown() {
+		checks["shutdown"] = readyCheck{false, "shutting down"}
+		ready = false
+	}
+
+	if hasDB() {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second)
+		defer cancel()
+		if err := DB.PingContext(ctx); err != nil {
+			checks["db"] = readyCheck{false, err.Error()}
+			ready = false
+		} else {
+			checks["db"] = readyCheck{Ok: true}
+		}
+	}
+
+	if game == nil || game.Defs == nil {
+		checks["definitions"] = readyCheck{false, "definitions not loaded"}
+		checks["game_loop"] = readyCheck{false, "game not started"}
+		ready = false
+	} else {
+		checks["definitions"] = readyCheck{Ok: true}
+		tick := game.TickTiming.Stats()
+		if age := time.Since(tick.At); tick.Count == 0 || age > MAX_TICK_AGE {
+			checks["game_loop"] = readyCheck{false, fmt.Sprintf("last tick %v ago", age)}
+			ready = false
+		} else {
+			checks["game_loop"] = readyCheck{Ok: true}
+		}
+		if lag := game.PersistStats().Lag; lag > rpg.MAX_PERSIST_LAG {
+			checks["persistence"] = readyCheck{false, fmt.Sprintf("changes unsaved for %v", lag)}
+			ready = false
+		} else {
+			checks["persistence"] = readyCheck{Ok: true}
+		}
+	}
+
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	jsonWrite(w, checks)
+}
+
+type metricSample struct {
+	labels map[string]string
+	value  float64
+}
+
+func writeMetric(w io.Writer, name, help, kind string, samples ...metricSample) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	writeSamples(w, name, samples)
+}
+
+func writeSamples(w io.Writer, name string, samples []metricSample) {
+	for _, s := range samples {
+		fmt.Fprint(w, name)
+		if len(s.labels) > 0 {
+			keys := make([]string, 0, len(s.labels))
+			for k := range s.labels {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			fmt.Fprint(w, "{")
+			for i, k := range keys {
+				if i > 0 {
+					fmt.Fprint(w, ",")
+				}
+				fmt.Fprintf(w, "%s=%s", k, strconv.Quote(s.labels[k]))
+			}
+			fmt.Fprint(w, "}")
+		}
+		fmt.Fprintf(w, " %s\n", strconv.FormatFloat(s.value, 'g', -1, 64))
+	}
+}
+
+func value(v float64) metricSample {
+	return metricSample{value: v}
+}
+
+func labelled(v float64, labels ...string) metricSample {
+	s := metricSample{labels: make(map[string]string), value: v}
+	for i := 0; i+1 < len(labels); i += 2 {
+		s.labels[labels[i]] = labels[i+1]
+	}
+	return s
+}
+
+func writeTiming(w io.Writer, name, help string, timings map[string]rpg.TimingStats, label string) {
+	sums := make([]metricSample, 0)
+	counts := make([]metricSample, 0)
+	for key, t := range timings {
+		if label == "" {
+			sums = append(sums, value(t.Total.Seconds()))
+			counts = append(counts, value(float64(t.Count)))
+		} else {
+			sums = append(sums, labelled(t.Total.Seconds(), label, key))
+			counts = append(counts, labelled(float64(t.Count), label, key))
+		}
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s summary\n", name, help, name)
+	writeSamples(w, name+"_sum", sums)
+	writeSamples(w, name+"_count", counts)
+}
+
+// metrics serves everything in the Prometheus text format.
+func metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	clientsMutex.Lock()
+	connected := len(clients)
+	authenticated := len(authenticatedClients)
+	linkdead := len(linkdeadClients)
+	queued := 0
+	for c := range clients {
+		queued += c.queue.Len()
+	}
+	clientsMutex.Unlock()
+
+	writeMetric(w, "px_clients_connected", "Open websocket connections.", "gauge",
+		value(float64(connected)))
+	writeMetric(w, "px_clients_authenticated", "Logged in clients.", "gauge",
+		value(float64(authenticated)))
+	writeMetric(w, "px_clients_linkdead", "Players waiting to reconnect.", "gauge",
+		value(float64(linkdead)))
+
+	writeMetric(w, "px_incoming_queue_depth", "Messages waiting for the websocket handlers.", "gauge",
+		value(float64(len(incoming))))
+	writeMetric(w, "px_outgoing_queue_depth", "Messages waiting to be written, across all clients.", "gauge",
+		value(float64(queued)))
+
+	rateCountersMutex.Lock()
+	allowed := make([]metricSample, 0)
+	for class, n := range rateCounters.Allowed {
+		allowed = append(allowed, labelled(float64(n), "class", class))
+	}
+	limited := make([]metricSample, 0)
+	for class, n := range rateCounters.Limited {
+		limited = append(limited, labelled(float64(n), "class", class))
+	}
+	kicked := rateCounters.Kicked
+	rateCountersMutex.Unlock()
+	writeMetric(w, "px_ratelimit_allowed_total", "Messages let through by the rate limiter.", "counter",
+		allowed...)
+	writeMetric(w, "px_ratelimit_limited_total", "Messages dropped by the rate limiter.", "counter",
+		limited...)
+	writeMetric(w, "px_ratelimit_kicked_total", "Clients disconnected for flooding.", "counter",
+		value(float64(kicked)))
+
+	if game == nil {
+		return
+	}
+
+	writeMetric(w, "px_game_incoming_depth", "Messages waiting for the game loop.", "gauge",
+		value(float64(len(game.Incoming))))
+	writeMetric(w, "px_game_outgoing_depth", "Messages waiting to leave the game loop.", "gauge",
+		value(float64(len(game.Outgoing))))
+
+	players := make([]metricSample, 0)
+	inCombat := 0
+	for _, z := range game.ZoneStats() {
+		players = append(players, labelled(float64(z.Players), "zone", strconv.Itoa(z.Id), "name", z.Name))
+		if z.InCombat {
+			inCombat += 1
+		}
+	}
+	writeMetric(w, "px_zone_players", "Players in each zone.", "gauge", players...)
+	writeMetric(w, "px_zones_in_combat", "Zones currently in combat.", "gauge",
+		value(float64(inCombat)))
+
+	tick := game.TickTiming.Stats()
+	writeTiming(w, "px_tick_duration_seconds", "Time spent in each game tick.",
+		map[string]rpg.TimingStats{"": tick}, "")
+	writeMetric(w, "px_tick_last_duration_seconds", "Duration of the most recent tick.", "gauge",
+		value(tick.Last.Seconds()))
+
+	persist := game.PersistStats()
+	writeTiming(w, "px_db_commit_duration_seconds", "Persister commit latency, how long each write of changed players, zones and items took.",
+		map[string]rpg.TimingStats{"": persist.Timing}, "")
+	writeMetric(w, "px_db_commit_failures_total", "Commits that failed and were left to retry.", "counter",
+		value(float64(persist.Failures)))
+	writeMetric(w, "px_db_refused_actions_total", "Player actions refused because saving fell too far behind.", "counter",
+		value(float64(persist.Refused)))
+	writeMetric(w, "px_db_pending_rows", "Changed rows waiting to be written.", "gauge",
+		value(float64(persist.Pending)))
+	writeMetric(w, "px_db_persist_lag_seconds", "Age of the oldest change that hasn't been written.", "gauge",
+		value(persist.Lag.Seconds()))
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Migrations are numbered SQL files, 0001_initial.sql and so on, applied in
+// order. Each runs in its own transaction along with its schema_version
+// row. Never edit one that's been released, add a new one instead.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+type migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+func loadMigrations() ([]migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := make([]migration, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		prefix := strings.SplitN(name, "_", 2)[0]
+		version, err := strconv.Atoi(prefix)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s doesn't start with a version", name)
+		}
+		data, err := migrationFiles.ReadFile(path.Join("migrations", name))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{version, name, string(data)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration %s is out of sequence, expected version %d", m.Name, i+1)
+		}
+	}
+	return migrations, nil
+}
+
+// latestSchemaVersion is the version this binary's migrations bring the
+// DB up to.
+func latestSchemaVersion() int {
+	migrations, err := loadMigrations()
+	if err != nil || len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+// SchemaVersion returns the version the DB is at, 0 if it's never been
+// migrated. It only reads, so it's safe against a DB nothing should touch.
+func SchemaVersion() (int, error) {
+	var exists bool
+	err := DB.QueryRow(`SELECT to_regclass('schema_version') IS NOT NULL`).Scan(&exists)
+	if err != nil || !exists {
+		return 0, err
+	}
+	var version int
+	err = DB.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version)
+	return version, err
+}
+
+func createSchemaVersionTable() error {
+	_, err := DB.Exec(`CREATE TABLE IF NOT EXISTS schema_version (
+        version integer PRIMARY KEY,
+        name text NOT NULL,
+        applied_at timestamptz NOT NULL DEFAULT now()
+    )`)
+	return err
+}
+
+// CheckSchema refuses to run against a DB migrated by a newer server, the
+// old code could easily write data the new schema doesn't expect. Only the
+// server checks, commands like db version still work.
+func CheckSchema() error {
+	version, err := SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if latest := latestSchemaVersion(); version > latest {
+		return fmt.Errorf("DB schema is at version %d but this server only knows up to %d, upgrade the server", version, latest)
+	}
+	return nil
+}
+
+// Migrate applies any migrations the DB hasn't had yet and returns how many
+// ran.
+func Migrate() (int, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return 0, err
+	}
+	if err := CheckSchema(); err != nil {
+		return 0, err
+	}
+	if err := createSchemaVersionTable(); err != nil {
+		return 0, err
+	}
+	version, err := SchemaVersion()
+	if err != nil {
+		return 0, err
+	}
+
+	applied := 0
+	for _, m := range migrations {
+		if m.Version <= version {
+			continue
+		}
+		if err := applyMigration(m); err != nil {
+			return applied, fmt.Errorf("migration %s failed: %v", m.Name, err)
+		}
+		log.Printf("[db] applied migration %s", m.Name)
+		applied++
+	}
+	return applied, nil
+}
+
+// startupMigrate brings the DB up to date before the server starts, or
+// with migrations skipped makes sure someone already has.
+func startupMigrate(skip bool) error {
+	if !skip {
+		_, err := Migrate()
+		return err
+	}
+	if err := CheckSchema(); err != nil {
+		return err
+	}
+	version, err := SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if latest := latestSchemaVersion(); version < latest {
+		return fmt.Errorf("DB schema is at version %d, run db migrate to bring it up to %d", version, latest)
+	}
+	return nil
+}
+
+func applyMigration(m migration) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(m.SQL); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_version(version, name) VALUES ($1, $2)`,
+		m.Version, m.Name); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
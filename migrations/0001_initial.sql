@@ -0,0 +1,19 @@
+-- players doubles as the user table, data holds the game's player state
+CREATE TABLE IF NOT EXISTS players (
+    id serial PRIMARY KEY,
+    name text NOT NULL,
+    name_normal text NOT NULL UNIQUE,
+    password text,
+    superuser boolean NOT NULL DEFAULT false,
+    data jsonb
+);
+
+CREATE TABLE IF NOT EXISTS zones (
+    id serial PRIMARY KEY,
+    data jsonb
+);
+
+CREATE TABLE IF NOT EXISTS items (
+    id serial PRIMARY KEY,
+    data jsonb
+);
@@ -0,0 +1,39 @@
+CREATE TABLE IF NOT EXISTS bans (
+    id serial PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES players(id),
+    banned_by integer REFERENCES players(id),
+    reason text NOT NULL DEFAULT '',
+    created_at timestamptz NOT NULL DEFAULT now(),
+    expires_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS bans_user_id ON bans(user_id);
+
+CREATE TABLE IF NOT EXISTS mutes (
+    id serial PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES players(id),
+    muted_by integer REFERENCES players(id),
+    reason text NOT NULL DEFAULT '',
+    created_at timestamptz NOT NULL DEFAULT now(),
+    expires_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS mutes_user_id ON mutes(user_id);
+
+CREATE TABLE IF NOT EXISTS moderation_log (
+    id serial PRIMARY KEY,
+    action text NOT NULL,
+    moderator_id integer REFERENCES players(id),
+    target_id integer NOT NULL REFERENCES players(id),
+    reason text NOT NULL DEFAULT '',
+    created_at timestamptz NOT NULL DEFAULT now(),
+    expires_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS moderation_log_target_id ON moderation_log(target_id);
+
+CREATE TABLE IF NOT EXISTS admin_audit (
+    id serial PRIMARY KEY,
+    admin_id integer NOT NULL REFERENCES players(id),
+    action text NOT NULL,
+    target text NOT NULL DEFAULT '',
+    details text NOT NULL DEFAULT '',
+    created_at timestamptz NOT NULL DEFAULT now()
+);
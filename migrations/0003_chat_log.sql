@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS chat_log (
+    id bigint PRIMARY KEY,
+    channel text NOT NULL,
+    zone_id integer,
+    from_id integer,
+    to_id integer,
+    from_name text NOT NULL DEFAULT '',
+    to_name text NOT NULL DEFAULT '',
+    content text NOT NULL,
+    class text NOT NULL DEFAULT '',
+    created_at timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS chat_log_channel ON chat_log(channel, id);
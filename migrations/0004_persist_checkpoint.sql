@@ -0,0 +1,7 @@
+-- sequence number of the last snapshot the persister committed, journal
+-- entries up to it are already in and aren't replayed
+CREATE TABLE IF NOT EXISTS persist_checkpoint (
+    id integer PRIMARY KEY CHECK (id = 1),
+    seq bigint NOT NULL
+);
+INSERT INTO persist_checkpoint (id, seq) VALUES (1, 0) ON CONFLICT DO NOTHING;
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	MODERATION_BAN    = "ban"
+	MODERATION_UNBAN  = "unban"
+	MODERATION_MUTE   = "mute"
+	MODERATION_UNMUTE = "unmute"
+	MODERATION_KICK   = "kick"
+
+	DEFAULT_MODERATION_LOG_LIMIT = 50
+	MAX_MODERATION_LOG_LIMIT     = 200
+)
+
+type moderationEntry struct {
+	Id        int        `json:"id"`
+	Action    string     `json:"action"`
+	Moderator string     `json:"moderator"`
+	Target    string     `json:"target"`
+	Reason    string     `json:"reason"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+func expiryFor(duration time.Duration) sql.NullTime {
+	if duration <= 0 {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: time.Now().Add(duration), Valid: true}
+}
+
+// ParseModerationDuration reads durations like 30m, 12h or 7d. An empty
+// string, 0 or "perm" is permanent.
+func ParseModerationDuration(s string) (time.Duration, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" || s == "0" || s == "perm" {
+		return 0, nil
+	}
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || days < 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil || duration < 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return duration, nil
+}
+
+// logModeration records a moderation action, these are kept even after a
+// ban or mute expires.
+func logModeration(action string, moderator, target User, reason string, expires sql.NullTime) {
+	log.Printf("[moderation] %s: %s %s (%s)", moderator.NameNormal, action, target.NameNormal, reason)
+	if !hasDB() {
+		return
+	}
+	_, err := DB.Exec(`INSERT INTO moderation_log(action, moderator_id, target_id, reason, expires_at)
+        VALUES ($1, $2, $3, $4, $5)`, action, moderator.Id, target.Id, reason, expires)
+	if err != nil {
+		log.Printf("[moderation] error writing moderation log: %v", err)
+	}
+}
+
+// BanUser bans a user and disconnects them, a zero duration is permanent.
+func BanUser(target, moderator User, reason string, duration time.Duration) error {
+	if !hasDB() {
+		return ErrorNoDatabase
+	}
+	expires := expiryFor(duration)
+	_, err := DB.Exec(`INSERT INTO bans(user_id, banned_by, reason, expires_at)
+        VALUES ($1, $2, $3, $4)`, target.Id, moderator.Id, reason, expires)
+	if err != nil {
+		return err
+	}
+	logModeration(MODERATION_BAN, moderator, target, reason, expires)
+	disconnectUser(target.Id, ErrorBanned)
+	return nil
+}
+
+// UnbanUser ends any active bans early, the rows are kept for the log.
+func UnbanUser(target, moderator User, reason string) error {
+	if !hasDB() {
+		return ErrorNoDatabase
+	}
+	_, err := DB.Exec(`UPDATE bans SET expires_at = now() WHERE user_id = $1
+        AND (expires_at IS NULL OR expires_at > now())`, target.Id)
+	if err != nil {
+		return err
+	}
+	logModeration(MODERATION_UNBAN, moderator, target, reason, sql.NullTime{})
+	return nil
+}
+
+// MuteUser stops a user chatting, a zero duration is permanent.
+func MuteUser(target, moderator User, reason string, duration time.Duration) error {
+	if !hasDB() {
+		return ErrorNoDatabase
+	}
+	expires := expiryFor(duration)
+	_, err := DB.Exec(`INSERT INTO mutes(user_id, muted_by, reason, expires_at)
+        VALUES ($1, $2, $3, $4)`, target.Id, moderator.Id, reason, expires)
+	if err != nil {
+		return err
+	}
+	logModeration(MODERATION_MUTE, moderator, target, reason, expires)
+	return nil
+}
+
+func UnmuteUser(target, moderator User, reason string) error {
+	if !hasDB() {
+		return ErrorNoDatabase
+	}
+	_, err := DB.Exec(`UPDATE mutes SET expires_at = now() WHERE user_id = $1
+        AND (expires_at IS NULL OR expires_at > now())`, target.Id)
+	if err != nil {
+		return err
+	}
+	logModeration(MODERATION_UNMUTE, moderator, target, reason, sql.NullTime{})
+	return nil
+}
+
+// KickUser disconnects a user and logs it, returns false if they weren't
+// online.
+func KickUser(target, moderator User, reason string) bool {
+	if !disconnectUser(target.Id, ErrorKicked) {
+		return false
+	}
+	logModeration(MODERATION_KICK, moderator, target, reason, sql.NullTime{})
+	return true
+}
+
+// checkBanned is used at login, token refresh and websocket auth. Returns
+// ErrorBanned for banned users, or ErrorInternal if the check failed.
+// Without a database nobody can be banned.
+func checkBanned(user User) error {
+	if !hasDB() {
+		return nil
+	}
+	var banned bool
+	err := DB.QueryRow(`SELECT EXISTS(SELECT 1 FROM bans WHERE user_id = $1
+        AND (expires_at IS NULL OR expires_at > now()))`, user.Id).Scan(&banned)
+	if err != nil {
+		log.Printf("SQL Error: %v", err)
+		return ErrorInternal
+	}
+	if banned {
+		return ErrorBanned
+	}
+	return nil
+}
+
+// checkCanChat is checked before every chat message, bans are checked too
+// in case one was added while the user was connected.
+func checkCanChat(user User) error {
+	if !hasDB() {
+		return nil
+	}
+	var banned, muted bool
+	err := DB.QueryRow(`SELECT
+        EXISTS(SELECT 1 FROM bans WHERE user_id = $1
+            AND (expires_at IS NULL OR expires_at > now())),
+        EXISTS(SELECT 1 FROM mutes WHERE user_id = $1
+            AND (expires_at IS NULL OR expires_at > now()))`, user.Id).Scan(&banned, &muted)
+	if err != nil {
+		log.Printf("SQL Error: %v", err)
+		return ErrorInternal
+	}
+	if banned {
+		return ErrorBanned
+	}
+	if muted {
+		return ErrorMuted
+	}
+	return nil
+}
+
+// ModerationLog returns entries newest first, optionally for a single user.
+// Pass the last id seen as before to get the next page.
+func ModerationLog(targetId, before, limit int) ([]moderationEntry, error) {
+	if limit <= 0 {
+		limit = DEFAULT_MODERATION_LOG_LIMIT
+	}
+	if limit > MAX_MODERATION_LOG_LIMIT {
+		limit = MAX_MODERATION_LOG_LIMIT
+	}
+	if !hasDB() {
+		return nil, ErrorNoDatabase
+	}
+
+	rows, err := DB.Query(`SELECT m.id, m.action, COALESCE(moderator.name, ''), COALESCE(target.name, ''),
+            m.reason, m.created_at, m.expires_at
+        FROM moderation_log m
+        LEFT JOIN players moderator ON moderator.id = m.moderator_id
+        LEFT JOIN players target ON target.id = m.target_id
+        WHERE ($1 = 0 OR m.target_id = $1) AND ($2 = 0 OR m.id < $2)
+        ORDER BY m.id DESC LIMIT $3`, targetId, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]moderationEntry, 0)
+	for rows.Next() {
+		var e moderationEntry
+		var expires sql.NullTime
+		if err := rows.Scan(&e.Id, &e.Action, &e.Moderator, &e.Target,
+			&e.Reason, &e.CreatedAt, &expires); err != nil {
+			return nil, err
+		}
+		if expires.Valid {
+			e.ExpiresAt = &expires.Time
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+type moderationLogRequest struct {
+	User   string `json:"user"`
+	Before int    `json:"before"`
+	Limit  int    `json:"limit"`
+}
+
+func handleModerationLog(source *Client, requestId string, data []byte) (interface{}, error) {
+	if !source.Authenticated || !source.User.SuperUser {
+		return nil, ErrorUnauthenticated
+	}
+
+	var req moderationLogRequest
+	if err := parseIncoming(source, data, &req); err != nil {
+		return nil, err
+	}
+
+	targetId := 0
+	if req.User != "" {
+		target, err := LoadUser(normalizeUsername(req.User))
+		if err != nil {
+			return nil, ErrorUserMissing
+		}
+		targetId = target.Id
+	}
+
+	entries, err := ModerationLog(targetId, req.Before, req.Limit)
+	if err != nil {
+		log.Printf("[moderation] error reading moderation log: %v", err)
+		return nil, storageErr(err)
+	}
+
+	return WSResponse{
+		Error:  0,
+		Action: ACTION_MODERATION_LOG,
+		Data:   entries,
+	}, nil
+}
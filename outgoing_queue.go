@@ -1,20 +1,215 @@
 package main
 
-import "log"
+import (
+	"log"
+	"sync"
+	"time"
 
-type outgoingMessage struct {
-	Data interface{}
-	Dest *Client
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// drop the oldest queued state update (or oldest message) when full
+	QUEUE_POLICY_DROP_OLDEST = "drop_oldest"
+	// replace any queued state updates with the newest full state, then drop oldest
+	QUEUE_POLICY_COALESCE = "coalesce"
+	// close the client as soon as its queue is full
+	QUEUE_POLICY_DISCONNECT = "disconnect"
+
+	DEFAULT_QUEUE_SIZE = 64
+	WRITE_TIMEOUT      = 10 * time.Second
+)
+
+var queueSize = DEFAULT_QUEUE_SIZE
+var queuePolicy = QUEUE_POLICY_COALESCE
+
+func ValidQueuePolicy(policy string) bool {
+	return policy == QUEUE_POLICY_DROP_OLDEST ||
+		policy == QUEUE_POLICY_COALESCE ||
+		policy == QUEUE_POLICY_DISCONNECT
+}
+
+// closeMessage is queued like any other message so the client gets
+// everything sent before it, then a close frame with the reason.
+type closeMessage struct {
+	Code   int
+	Reason string
+}
+
+type outgoingQueue struct {
+	mutex   sync.Mutex
+	items   []interface{}
+	signal  chan bool
+	closed  bool
+	dropped int
+	// set when a state update was dropped, the client's copy of the game
+	// state is stale and the next update has to be a full snapshot
+	resync bool
+}
+
+func newOutgoingQueue() *outgoingQueue {
+	return &outgoingQueue{
+		items:  make([]interface{}, 0, queueSize),
+		signal: make(chan bool, 1),
+	}
+}
+
+func isStateUpdate(data interface{}) bool {
+	resp, ok := data.(WSResponse)
+	return ok && (resp.Action == ACTION_GAME_STATE || resp.Action == ACTION_GAME_STATE_DELTA)
+}
+
+func isFullState(data interface{}) bool {
+	resp, ok := data.(WSResponse)
+	return ok && resp.Action == ACTION_GAME_STATE
+}
+
+func isDelta(data interface{}) bool {
+	resp, ok := data.(WSResponse)
+	return ok && resp.Action == ACTION_GAME_STATE_DELTA
 }
 
-var outgoing = make(chan outgoingMessage)
+// Push queues a message, applying the configured policy if the queue is
+// full. Returns false if the client should be disconnected.
+func (q *outgoingQueue) Push(data interface{}) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return true
+	}
+
+	// a full snapshot supersedes every state update queued before it
+	if queuePolicy == QUEUE_POLICY_COALESCE && isFullState(data) {
+		q.removeStateUpdates()
+	}
+
+	if len(q.items) >= queueSize {
+		if queuePolicy == QUEUE_POLICY_DISCONNECT {
+			return false
+		}
+		q.dropOldest()
+	}
 
-func outgoingMessages() {
+	// a delta is against state the client may not have got, the dropped
+	// updates mean the next SendGameState sends a full snapshot instead
+	if q.resync && isDelta(data) {
+		q.dropped += 1
+		return true
+	}
+
+	q.items = append(q.items, data)
+
+	select {
+	case q.signal <- true:
+	default:
+	}
+
+	return true
+}
+
+// dropOldest drops queued state updates before anything else. Deltas only
+// make sense applied in order, so they all go together and the client is
+// flagged for a full resync.
+func (q *outgoingQueue) dropOldest() {
+	if removed := q.removeStateUpdates(); removed > 0 {
+		q.resync = true
+		q.dropped += removed
+		return
+	}
+	q.items = q.items[1:]
+	q.dropped += 1
+}
+
+func (q *outgoingQueue) removeStateUpdates() int {
+	kept := make([]interface{}, 0, queueSize)
+	for _, queued := range q.items {
+		if !isStateUpdate(queued) {
+			kept = append(kept, queued)
+		}
+	}
+	removed := len(q.items) - len(kept)
+	q.items = kept
+	return removed
+}
+
+// TakeResync returns true (once) if a state update was dropped since the
+// last call.
+func (q *outgoingQueue) TakeResync() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	resync := q.resync
+	q.resync = false
+	return resync
+}
+
+// pop takes everything currently queued, the second return value is false
+// once the queue is closed and empty.
+func (q *outgoingQueue) pop() ([]interface{}, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	items := q.items
+	q.items = make([]interface{}, 0, queueSize)
+	return items, len(items) > 0 || !q.closed
+}
+
+func (q *outgoingQueue) Close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return
+	}
+	q.closed = true
+	close(q.signal)
+}
+
+func (q *outgoingQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.items)
+}
+
+// writeMessages is the writer goroutine for a single client, a failed
+// write only closes that client.
+func (c *Client) writeMessages() {
+	defer close(c.writerDone)
+	for range c.queue.signal {
+		if !c.flush() {
+			return
+		}
+	}
+	// drain anything left after close
+	c.flush()
+}
+
+func (c *Client) flush() bool {
 	for {
-		out := <-outgoing
-		err := out.Dest.Conn.WriteJSON(out.Data)
-		if err != nil {
-			log.Fatal(err)
+		items, ok := c.queue.pop()
+		if !ok || len(items) == 0 {
+			return ok
+		}
+		for _, data := range items {
+			deadline := time.Now().Add(WRITE_TIMEOUT)
+			if msg, ok := data.(closeMessage); ok {
+				frame := websocket.FormatCloseMessage(msg.Code, msg.Reason)
+				c.Conn.WriteControl(websocket.CloseMessage, frame, deadline)
+				c.Disconnect()
+				return false
+			}
+			frame, err := c.codec.Marshal(data)
+			if err != nil {
+				log.Printf("[ws/send] error encoding %T for %s: %v", data, c.Conn.RemoteAddr(), err)
+				continue
+			}
+			c.Conn.SetWriteDeadline(deadline)
+			if err := c.Conn.WriteMessage(c.codec.FrameType(), frame); err != nil {
+				log.Printf("[ws/send] error writing to %s: %v", c.Conn.RemoteAddr(), err)
+				c.Disconnect()
+				return false
+			}
 		}
 	}
 }
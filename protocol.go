@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log"
+)
+
+const (
+	// bump this whenever DisplayData, OutgoingMessage params or any other
+	// payload changes shape
+	PROTOCOL_VERSION = 1
+
+	// game_state_delta updates instead of full game_state every time
+	FEATURE_STATE_DELTA = "state_delta"
+)
+
+var minProtocolVersion = PROTOCOL_VERSION
+
+var serverFeatures = []string{
+	FEATURE_STATE_DELTA,
+}
+
+type (
+	helloRecv struct {
+		Version  int      `json:"version"`
+		Build    string   `json:"build"`
+		Features []string `json:"features"`
+	}
+	helloSend struct {
+		Version    int      `json:"version"`
+		MinVersion int      `json:"minVersion"`
+		Encoding   string   `json:"encoding"`
+		Features   []string `json:"features"`
+	}
+)
+
+// helloHandler is the first thing a client sends, it has to happen before
+// login so the server knows what the client understands.
+func helloHandler(source *Client, requestId string, data []byte) (interface{}, error) {
+	var hello helloRecv
+
+	if err := parseIncoming(source, data, &hello); err != nil {
+		return nil, ErrorInvalidData
+	}
+
+	if hello.Version < minProtocolVersion {
+		log.Printf("[ws/hello] %s is too old (version %d, build %s)",
+			source.Conn.RemoteAddr(), hello.Version, hello.Build)
+		source.Kick(ErrorProtocolTooOld)
+		return nil, nil
+	}
+
+	// only enable what both sides support
+	enabled := make(map[string]bool)
+	for _, f := range hello.Features {
+		for _, supported := range serverFeatures {
+			if f == supported {
+				enabled[f] = true
+			}
+		}
+	}
+	features := make([]string, 0, len(enabled))
+	for f := range enabled {
+		features = append(features, f)
+	}
+
+	source.ProtocolVersion = hello.Version
+	source.Features = enabled
+
+	log.Printf("[ws/hello] %s version %d (build %s) features %v",
+		source.Conn.RemoteAddr(), hello.Version, hello.Build, features)
+
+	return helloSend{
+		Version:    PROTOCOL_VERSION,
+		MinVersion: minProtocolVersion,
+		Encoding:   source.codec.Name(),
+		Features:   features,
+	}, nil
+}
+
+func (c *Client) HasFeature(feature string) bool {
+	return c.Features[feature]
+}
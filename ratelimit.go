@@ -0,0 +1,215 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// action classes, each gets its own token bucket per client
+const (
+	RATE_CLASS_CHAT  = "chat"
+	RATE_CLASS_GAME  = "game"
+	RATE_CLASS_EDIT  = "edit"
+	RATE_CLASS_OTHER = "other"
+)
+
+type RateLimit struct {
+	// tokens added per second
+	Rate float64
+	// bucket size, i.e. how many messages can arrive at once
+	Burst int
+}
+
+var rateLimits = map[string]RateLimit{
+	RATE_CLASS_CHAT:  {Rate: 1, Burst: 5},
+	RATE_CLASS_GAME:  {Rate: 10, Burst: 20},
+	RATE_CLASS_EDIT:  {Rate: 20, Burst: 40},
+	RATE_CLASS_OTHER: {Rate: 5, Burst: 10},
+}
+
+const STRIKE_DECAY = 10 * time.Second
+
+// how many rate limited messages in a row (without a quiet STRIKE_DECAY
+// period in between) before the client gets disconnected
+var rateLimitStrikes = 20
+
+func rateClass(action ActionStr) string {
+	switch action {
+	case ACTION_CHAT_MESSAGE:
+		return RATE_CLASS_CHAT
+	case ACTION_GAME_ACTION:
+		return RATE_CLASS_GAME
+	case ACTION_GAME_EDIT_ACTION:
+		return RATE_CLASS_EDIT
+	default:
+		return RATE_CLASS_OTHER
+	}
+}
+
+type RateCounters struct {
+	Allowed map[string]int `json:"allowed"`
+	Limited map[string]int `json:"limited"`
+	Kicked  int            `json:"kicked"`
+}
+
+func newRateCounters() RateCounters {
+	return RateCounters{
+		Allowed: make(map[string]int),
+		Limited: make(map[string]int),
+	}
+}
+
+var rateCountersMutex = &sync.Mutex{}
+var rateCounters = newRateCounters()
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateLimiter struct {
+	mutex      sync.Mutex
+	buckets    map[string]*tokenBucket
+	strikes    int
+	lastStrike time.Time
+	counters   RateCounters
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		buckets:  make(map[string]*tokenBucket),
+		counters: newRateCounters(),
+	}
+}
+
+// Allow takes a token from the bucket for the action's class, the second
+// return value is the number of strikes the client has built up.
+func (l *rateLimiter) Allow(action ActionStr) (bool, int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	class := rateClass(action)
+	limit := rateLimits[class]
+	now := time.Now()
+
+	bucket, ok := l.buckets[class]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(limit.Burst), last: now}
+		l.buckets[class] = bucket
+	}
+
+	bucket.tokens += now.Sub(bucket.last).Seconds() * limit.Rate
+	if bucket.tokens > float64(limit.Burst) {
+		bucket.tokens = float64(limit.Burst)
+	}
+	bucket.last = now
+
+	rateCountersMutex.Lock()
+	defer rateCountersMutex.Unlock()
+
+	if bucket.tokens >= 1 {
+		bucket.tokens -= 1
+		l.counters.Allowed[class] += 1
+		rateCounters.Allowed[class] += 1
+		return true, l.strikes
+	}
+
+	if now.Sub(l.lastStrike) > STRIKE_DECAY {
+		l.strikes = 0
+	}
+	l.strikes += 1
+	l.lastStrike = now
+	l.counters.Limited[class] += 1
+	rateCounters.Limited[class] += 1
+	return false, l.strikes
+}
+
+// kicked counts the client being disconnected for flooding.
+func (l *rateLimiter) kicked() {
+	l.mutex.Lock()
+	l.counters.Kicked += 1
+	l.mutex.Unlock()
+
+	rateCountersMutex.Lock()
+	rateCounters.Kicked += 1
+	rateCountersMutex.Unlock()
+}
+
+func (l *rateLimiter) Counters() RateCounters {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	counters := newRateCounters()
+	for k, v := range l.counters.Allowed {
+		counters.Allowed[k] = v
+	}
+	for k, v := range l.counters.Limited {
+		counters.Limited[k] = v
+	}
+	counters.Kicked = l.counters.Kicked
+	return counters
+}
+
+// checkRateLimit is called for every message before it's queued, flooding
+// clients get a warning first and are disconnected if they keep going.
+func checkRateLimit(client *Client, msg WSMessage) bool {
+	allowed, strikes := client.limiter.Allow(msg.Action)
+	if allowed {
+		return true
+	}
+
+	if strikes >= rateLimitStrikes {
+		log.Printf("[ws/ratelimit] disconnecting %s for flooding", client.Conn.RemoteAddr())
+		client.limiter.kicked()
+		client.Kick(ErrorFlooding)
+		return false
+	}
+
+	if strikes == 1 {
+		log.Printf("[ws/ratelimit] %s is being rate limited (%s)", client.Conn.RemoteAddr(), msg.Action)
+	}
+	client.Write(WSResponse{
+		Id:      msg.Id,
+		Error:   ErrorRateLimited.Code(),
+		Message: ErrorRateLimited.ExternalMessage(),
+		Action:  msg.Action,
+	})
+	return false
+}
+
+type rateLimitReport struct {
+	Total   RateCounters            `json:"total"`
+	Clients map[string]RateCounters `json:"clients"`
+}
+
+func handleRateLimits(source *Client, requestId string, data []byte) (interface{}, error) {
+	if !source.Authenticated || !source.User.SuperUser {
+		return nil, ErrorUnauthenticated
+	}
+
+	report := rateLimitReport{Clients: make(map[string]RateCounters)}
+
+	clientsMutex.Lock()
+	for c := range clients {
+		name := c.Conn.RemoteAddr().String()
+		if c.Authenticated {
+			name = c.User.NameNormal
+		}
+		report.Clients[name] = c.limiter.Counters()
+	}
+	clientsMutex.Unlock()
+
+	rateCountersMutex.Lock()
+	report.Total = newRateCounters()
+	for k, v := range rateCounters.Allowed {
+		report.Total.Allowed[k] = v
+	}
+	for k, v := range rateCounters.Limited {
+		report.Total.Limited[k] = v
+	}
+	report.Total.Kicked = rateCounters.Kicked
+	rateCountersMutex.Unlock()
+
+	return report, nil
+}
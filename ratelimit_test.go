@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterBuckets(t *testing.T) {
+	tests := []struct {
+		action ActionStr
+		class  string
+	}{
+		{ACTION_CHAT_MESSAGE, RATE_CLASS_CHAT},
+		{ACTION_GAME_ACTION, RATE_CLASS_GAME},
+		{ACTION_GAME_EDIT_ACTION, RATE_CLASS_EDIT},
+		{ACTION_LIST_USERS, RATE_CLASS_OTHER},
+	}
+	for _, test := range tests {
+		t.Run(test.class, func(t *testing.T) {
+			l := newRateLimiter()
+			burst := rateLimits[test.class].Burst
+			for i := 0; i < burst; i++ {
+				if ok, _ := l.Allow(test.action); !ok {
+					t.Fatalf("message %d of a %d burst was limited", i+1, burst)
+				}
+			}
+			ok, strikes := l.Allow(test.action)
+			if ok || strikes != 1 {
+				t.Fatalf("past the burst: allowed %v, strikes %d", ok, strikes)
+			}
+
+			// a second's worth of refill
+			l.buckets[test.class].last = l.buckets[test.class].last.Add(-time.Second)
+			refill := int(rateLimits[test.class].Rate)
+			for i := 0; i < refill; i++ {
+				if ok, _ := l.Allow(test.action); !ok {
+					t.Fatalf("refilled message %d was limited", i+1)
+				}
+			}
+			if ok, _ := l.Allow(test.action); ok {
+				t.Errorf("allowed more than the refill")
+			}
+
+			counters := l.Counters()
+			if counters.Allowed[test.class] != burst+refill || counters.Limited[test.class] != 2 {
+				t.Errorf("counters = %+v", counters)
+			}
+		})
+	}
+}
+
+func TestRateLimiterClassesAreSeparate(t *testing.T) {
+	l := newRateLimiter()
+	for i := 0; i < rateLimits[RATE_CLASS_CHAT].Burst; i++ {
+		l.Allow(ACTION_CHAT_MESSAGE)
+	}
+	if ok, _ := l.Allow(ACTION_CHAT_MESSAGE); ok {
+		t.Fatalf("chat wasn't limited")
+	}
+	if ok, _ := l.Allow(ACTION_GAME_ACTION); !ok {
+		t.Errorf("a chat flood limited game actions")
+	}
+}
+
+func TestRateLimiterStrikesDecay(t *testing.T) {
+	l := newRateLimiter()
+	for i := 0; i < rateLimits[RATE_CLASS_CHAT].Burst; i++ {
+		l.Allow(ACTION_CHAT_MESSAGE)
+	}
+	l.Allow(ACTION_CHAT_MESSAGE)
+	if _, strikes := l.Allow(ACTION_CHAT_MESSAGE); strikes != 2 {
+		t.Fatalf("strikes = %d, want 2", strikes)
+	}
+	l.lastStrike = l.lastStrike.Add(-STRIKE_DECAY - time.Second)
+	l.buckets[RATE_CLASS_CHAT].last = time.Now()
+	if _, strikes := l.Allow(ACTION_CHAT_MESSAGE); strikes != 1 {
+		t.Errorf("strikes after a quiet period = %d, want 1", strikes)
+	}
+}
+
+func TestRateLimiterCountsKicks(t *testing.T) {
+	l := newRateLimiter()
+	l.kicked()
+	if kicked := l.Counters().Kicked; kicked != 1 {
+		t.Errorf("kicked = %d, want 1", kicked)
+	}
+}
@@ -10,14 +10,25 @@ import (
 
 var (
 	upgrader = websocket.Upgrader{
-		// temporary workaround for local dev
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
+		Subprotocols: wsSubprotocols,
+		CheckOrigin:  checkOrigin,
 	}
 )
 
 func join(w http.ResponseWriter, r *http.Request) {
+	if isShuttingDown() {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	ip := remoteIP(r)
+	if !acquireConnection(ip) {
+		log.Printf("[api/ws] too many connections, turning away %s", ip)
+		http.Error(w, "too many connections", http.StatusServiceUnavailable)
+		return
+	}
+	defer releaseConnection(ip)
+
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("[api/ws] error upgrading %s: %v", r.Host, err)
@@ -28,12 +39,18 @@ func join(w http.ResponseWriter, r *http.Request) {
 
 	defer ws.Close()
 
-	client := MakeClient(ws)
+	if !devMode && maxMessageSize > 0 {
+		ws.SetReadLimit(maxMessageSize)
+	}
+
+	codec := CodecFor(ws.Subprotocol())
+	client := MakeClient(ws, codec)
 	defer RemoveClient(client)
 
+	log.Printf("[api/ws] %s connected using %s", ws.RemoteAddr(), codec.Name())
+
 	for {
-		var wsMsg WSMessage
-		err := ws.ReadJSON(&wsMsg)
+		_, frame, err := ws.ReadMessage()
 		if _, ok := err.(*websocket.CloseError); ok {
 			log.Printf("[ws/recv] goodbye %s", ws.RemoteAddr())
 			return
@@ -41,14 +58,22 @@ func join(w http.ResponseWriter, r *http.Request) {
 			log.Printf("[ws/recv] error: %v", err)
 			return
 		}
+		wsMsg, err := codec.DecodeMessage(frame)
+		if err != nil {
+			log.Printf("[ws/recv] error decoding message from %s: %v", ws.RemoteAddr(), err)
+			return
+		}
 		// log.Printf("[ws_recv] %s/%s", wsMsg.Scope, wsMsg.Action)
 		if wsMsg.Action == ACTION_CLOSE {
 			log.Printf("[ws/recv] %s closed connection", ws.RemoteAddr())
 			return
 		}
-		if client.State >= CLOSING {
+		if client.State() >= CLOSING {
 			return
 		}
+		if !checkRateLimit(client, wsMsg) {
+			continue
+		}
 		incoming <- incomingAction{Msg: wsMsg, Source: client}
 	}
 }
@@ -83,6 +108,7 @@ func createUser(w http.ResponseWriter, r *http.Request) {
 }
 
 func login(w http.ResponseWriter, r *http.Request) {
+	username := r.FormValue("username")
 	password := r.FormValue("password")
 
 	if err := ValidatePassword(password); err != nil {
@@ -95,22 +121,88 @@ func login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := AuthenticateUser(password)
-	if err != nil {
+	user, err := AuthenticateUser(username, password)
+	if err == ErrorBanned || err == ErrorInternal {
+		jsonErr(w, ACTION_LOGIN, err.(ClientError))
+		return
+	} else if err != nil {
 		jsonErr(w, ACTION_LOGIN, ErrorInvalidLogin)
 		return
 	}
 
+	tokens, err := IssueTokens(user, "")
+	if err != nil {
+		log.Printf("[api/auth] error issuing token: %v", err)
+		jsonErr(w, ACTION_LOGIN, ErrorInternal)
+		return
+	}
+
 	jsonWrite(w, WSResponse{
 		Error:   0,
 		Message: "success",
 		Action:  ACTION_LOGIN,
-		Data:    user,
+		Data:    tokens,
 	})
 
 	log.Printf("[api/auth] user logged in %s", user.NameNormal)
 }
 
+func refreshToken(w http.ResponseWriter, r *http.Request) {
+	claims, err := ParseToken(r.FormValue("token"), TOKEN_TYPE_REFRESH)
+	if err != nil {
+		jsonErr(w, ACTION_REFRESH_TOKEN, err.(ClientError))
+		return
+	}
+
+	if !ConsumeRefreshToken(claims) {
+		log.Printf("[api/auth] refresh token reused for %s, revoking session", claims.NameNormal)
+		jsonErr(w, ACTION_REFRESH_TOKEN, ErrorInvalidToken)
+		return
+	}
+
+	user, err := LoadUser(claims.NameNormal)
+	if err != nil || user.Id != claims.Subject {
+		jsonErr(w, ACTION_REFRESH_TOKEN, ErrorInvalidToken)
+		return
+	}
+	if err := checkBanned(user); err != nil {
+		jsonErr(w, ACTION_REFRESH_TOKEN, err.(ClientError))
+		return
+	}
+
+	tokens, err := IssueTokens(user, claims.Session)
+	if err != nil {
+		log.Printf("[api/auth] error issuing token: %v", err)
+		jsonErr(w, ACTION_REFRESH_TOKEN, ErrorInternal)
+		return
+	}
+
+	jsonWrite(w, WSResponse{
+		Error:   0,
+		Message: "success",
+		Action:  ACTION_REFRESH_TOKEN,
+		Data:    tokens,
+	})
+}
+
+func revokeToken(w http.ResponseWriter, r *http.Request) {
+	claims, err := ParseToken(r.FormValue("token"), TOKEN_TYPE_REFRESH)
+	if err != nil {
+		jsonErr(w, ACTION_REVOKE_TOKEN, err.(ClientError))
+		return
+	}
+
+	RevokeSession(claims.Session)
+
+	jsonWrite(w, WSResponse{
+		Error:   0,
+		Message: "success",
+		Action:  ACTION_REVOKE_TOKEN,
+	})
+
+	log.Printf("[api/auth] session revoked for %s", claims.NameNormal)
+}
+
 func jsonWrite(w http.ResponseWriter, v interface{}) {
 	encoder := json.NewEncoder(w)
 	err := encoder.Encode(v)
@@ -1,45 +1,214 @@
 package main
 
 import (
+	"time"
+
 	"github.com/jdaiv/px-server/rpg"
 )
 
-func handleGameAction(source *Client, data []byte) (interface{}, error) {
+const TICK_INTERVAL = 125 * time.Millisecond
+
+type gameActionAck struct {
+	Success bool   `json:"success"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// tickGame drives the game loop's ticks until it's told to stop.
+func tickGame(stop chan bool) {
+	ticker := time.NewTicker(TICK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			game.Incoming <- rpg.IncomingMessage{
+				Data: rpg.IncomingMessageData{Type: rpg.ACTION_TICK},
+			}
+		}
+	}
+}
+
+// outgoingGameMessages forwards everything the rpg loop sends out to the
+// clients it's meant for.
+func outgoingGameMessages() {
+	for {
+		outgoing := <-game.Outgoing
+
+		if outgoing.Type == rpg.ACTION_ACK {
+			sendAck(outgoing)
+			continue
+		}
+
+		zone, ok := game.Zones.Get(outgoing.Zone)
+		if !ok {
+			continue
+		}
+
+		switch outgoing.Type {
+		case rpg.ACTION_UPDATE:
+			game.BuildDisplayData(zone)
+			clientsMutex.Lock()
+			for id := range zone.Players {
+				if client, ok := authenticatedClients[id]; ok {
+					client.SendGameState(game.BuildDisplayFor(id))
+				}
+			}
+			clientsMutex.Unlock()
+		case rpg.ACTION_CHAT:
+			messageStr, ok := outgoing.Params["message"].(string)
+			if !ok {
+				continue
+			}
+			msg := messageSend{
+				Content: messageStr,
+				From:    "server",
+				Class:   MESSAGE_CLASS_SERVER,
+			}
+			// messages with a sender are players talking in the zone
+			if from, ok := outgoing.Params["from"].(string); ok {
+				msg = messageSend{
+					Content: messageStr,
+					From:    from,
+					Channel: CHAT_CHANNEL_SAY,
+				}
+				if emote, _ := outgoing.Params["emote"].(bool); emote {
+					msg.Class = MESSAGE_CLASS_EMOTE
+				}
+				fromId, _ := outgoing.Params["fromId"].(int)
+				msg = recordChat(chatRecord{Message: msg, Zone: zone.Id, FromId: fromId})
+			}
+			response := WSResponse{
+				Error:  0,
+				Action: ACTION_CHAT_MESSAGE,
+				Data:   msg,
+			}
+			if outgoing.PlayerId >= 0 {
+				clientsMutex.Lock()
+				if client, ok := authenticatedClients[outgoing.PlayerId]; ok {
+					client.Write(response)
+				}
+				clientsMutex.Unlock()
+			} else {
+				writeToZone(zone, response)
+			}
+		default:
+			writeToZone(zone, WSResponse{
+				Error:  0,
+				Action: ActionStr(outgoing.Type),
+				Data:   outgoing.Params,
+			})
+		}
+	}
+}
+
+// writeToZone sends a message to every connected player in the zone,
+// linkdead players are skipped.
+func writeToZone(zone *rpg.Zone, response WSResponse) {
+	clientsMutex.Lock()
+	for id := range zone.Players {
+		if client, ok := authenticatedClients[id]; ok {
+			client.Write(response)
+		}
+	}
+	clientsMutex.Unlock()
+}
+
+func sendAck(outgoing rpg.OutgoingMessage) {
+	id, _ := outgoing.Params["id"].(string)
+	success, _ := outgoing.Params["success"].(bool)
+
+	clientsMutex.Lock()
+	client, ok := authenticatedClients[outgoing.PlayerId]
+	clientsMutex.Unlock()
+	if !ok {
+		return
+	}
+
+	action := ActionStr(ACTION_GAME_ACTION)
+	if actionType, _ := outgoing.Params["type"].(string); actionType == rpg.ACTION_EDIT {
+		action = ACTION_GAME_EDIT_ACTION
+	}
+
+	response := WSResponse{
+		Error:  0,
+		Id:     id,
+		Action: action,
+		Data:   gameActionAck{Success: success},
+	}
+
+	if err, ok := outgoing.Params["error"].(error); ok {
+		cErr := RPGClientError(err)
+		reason := "internal_error"
+		if actionErr, ok := err.(*rpg.ActionError); ok {
+			reason = actionErr.Reason
+		}
+		response.Error = cErr.Code()
+		response.Message = cErr.ExternalMessage()
+		response.Data = gameActionAck{Success: false, Reason: reason}
+	}
+
+	client.Write(response)
+}
+
+func handleGameAction(source *Client, requestId string, data []byte) (interface{}, error) {
 	if !source.Authenticated {
 		return nil, ErrorUnauthenticated
 	}
 
 	var msg rpg.IncomingMessageData
 
-	if err := parseIncoming(data, &msg); err != nil {
+	if err := parseIncoming(source, data, &msg); err != nil {
 		return nil, err
 	}
 
 	if legal, ok := rpg.PlayerIncomingActions[msg.Type]; !legal || !ok {
-		return nil, nil
+		return nil, ErrorActInvalidAction
 	}
 
-	game.Incoming <- rpg.IncomingMessage{PlayerId: source.User.Id, Data: msg}
+	game.Incoming <- rpg.IncomingMessage{
+		PlayerId:  source.User.Id,
+		RequestId: requestId,
+		Data:      msg,
+	}
 
 	return nil, nil
 }
 
-func handleGameEditAction(source *Client, data []byte) (interface{}, error) {
+func handleGameResync(source *Client, requestId string, data []byte) (interface{}, error) {
+	if !source.Authenticated {
+		return nil, ErrorUnauthenticated
+	}
+
+	source.Resync()
+	game.Incoming <- rpg.IncomingMessage{
+		PlayerId: source.User.Id,
+		Data:     rpg.IncomingMessageData{Type: rpg.ACTION_RESYNC},
+	}
+
+	return nil, nil
+}
+
+func handleGameEditAction(source *Client, requestId string, data []byte) (interface{}, error) {
 	if !source.Authenticated || !source.User.SuperUser {
 		return nil, ErrorUnauthenticated
 	}
 
 	var msg rpg.IncomingMessageData
 
-	if err := parseIncoming(data, &msg); err != nil {
+	if err := parseIncoming(source, data, &msg); err != nil {
 		return nil, err
 	}
 
 	if msg.Type != rpg.ACTION_EDIT {
-		return nil, nil
+		return nil, ErrorActInvalidAction
 	}
 
-	game.Incoming <- rpg.IncomingMessage{PlayerId: source.User.Id, Data: msg}
+	game.Incoming <- rpg.IncomingMessage{
+		PlayerId:  source.User.Id,
+		RequestId: requestId,
+		Data:      msg,
+	}
 
 	return nil, nil
 }
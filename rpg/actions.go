@@ -2,7 +2,17 @@ package rpg
 
 const (
 	// _internal_ incoming actions
-	ACTION_TICK = "tick"
+	ACTION_TICK      = "tick"
+	ACTION_RESYNC    = "resync"
+	ACTION_LINKDEAD  = "linkdead"
+	ACTION_RESUME    = "resume"
+	ACTION_SAVE      = "save"
+	ACTION_TELEPORT  = "teleport"
+	ACTION_SHUTDOWN  = "shutdown"
+	ACTION_SAY       = "say"
+	ACTION_UNSTUCK   = "unstuck"
+	ACTION_SPAWN_NPC = "spawn_npc"
+	ACTION_GIVE_ITEM = "give_item"
 	// incoming actions
 	ACTION_JOIN         = "join"
 	ACTION_LEAVE        = "leave"
@@ -20,6 +30,7 @@ const (
 	ACTION_UPDATE_PLAYER = "player_update"
 	ACTION_CHAT          = "chat_message"
 	ACTION_EFFECT        = "play_effect"
+	ACTION_ACK           = "ack"
 	// special actions
 	ACTION_EDIT = "edit"
 )
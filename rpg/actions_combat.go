@@ -2,11 +2,11 @@ package rpg
 
 import "log"
 
-func (g *RPG) PlayerAttack(p *Player, z *Zone, params ActionParams) {
+func (g *RPG) PlayerAttack(p *Player, z *Zone, params ActionParams) error {
 	mode, ok := params.getString("mode")
 	if !ok {
 		log.Println("couldn't find mode param")
-		return
+		return ErrInvalidParams
 	}
 
 	switch mode {
@@ -14,24 +14,24 @@ func (g *RPG) PlayerAttack(p *Player, z *Zone, params ActionParams) {
 		npcId, ok := params.getInt("id")
 		if !ok {
 			log.Println("couldn't find npc id param")
-			return
+			return ErrInvalidParams
 		}
 
 		npc, ok := z.NPCs[npcId]
 		if !ok {
 			log.Printf("[rpg/zone/%s/attack] couldn't find npc %d", z.Name, npcId)
-			return
+			return ErrUnknownTarget
 		}
 
 		if !nextTo(p.X, p.Y, npc.X, npc.Y) {
 			log.Printf("[rpg/zone/%s/attack] player %d tried to attack %d but was too far away", z.Name, p.Id, npcId)
-			return
+			return ErrOutOfRange
 		}
 
 		log.Printf("[rpg/zone/%s/attack] attacking %d", z.Name, npcId)
 
 		if !p.CheckAPCost(1) {
-			return
+			return ErrNotEnoughAP
 		}
 
 		dmg := g.DoMeleeAttack(z, p, npc)
@@ -49,26 +49,30 @@ func (g *RPG) PlayerAttack(p *Player, z *Zone, params ActionParams) {
 		spellId, ok := params.getString("spell")
 		if !ok {
 			log.Println("couldn't find spell param")
-			return
+			return ErrInvalidParams
 		}
 		x, ok := params.getInt("x")
 		if !ok {
 			log.Println("couldn't find x param")
-			return
+			return ErrInvalidParams
 		}
 		y, ok := params.getInt("y")
 		if !ok {
 			log.Println("couldn't find y param")
-			return
+			return ErrInvalidParams
 		}
 		spell, ok := g.Defs.Spells[spellId]
 		if !ok {
 			log.Println("couldn't find spell")
-			return
+			return ErrInvalidParams
 		}
 		if !p.CheckAPCost(spell.Cost) {
-			return
+			return ErrNotEnoughAP
 		}
 		g.DoSpellAttack(z, p, spell, x, y)
+	default:
+		return ErrInvalidParams
 	}
+
+	return nil
 }
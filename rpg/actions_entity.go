@@ -2,28 +2,28 @@ package rpg
 
 import "log"
 
-func (g *RPG) PlayerUse(p *Player, z *Zone, params ActionParams) {
+func (g *RPG) PlayerUse(p *Player, z *Zone, params ActionParams) error {
 	entId, ok := params.getInt("id")
 	if !ok {
 		log.Println("couldn't find ent id param")
-		return
+		return ErrInvalidParams
 	}
 
 	ent, ok := z.Entities[entId]
 	if !ok {
 		log.Printf("[rpg/zone/%s/use] couldn't find ent %d", z.Name, entId)
-		return
+		return ErrUnknownTarget
 	}
 
 	if !nextTo(p.X, p.Y, ent.X, ent.Y) {
 		log.Printf("[rpg/zone/%s/use] player %d tried to use ent %d, but was too far away", z.Name, p.Id, entId)
-		return
+		return ErrOutOfRange
 	}
 
 	log.Printf("[rpg/zone/%s/use] using ent %d", z.Name, entId)
 
 	if !p.CheckAPCost(1) {
-		return
+		return ErrNotEnoughAP
 	}
 
 	needsUpdate, err := g.UseEntity(z, ent, p)
@@ -34,4 +34,9 @@ func (g *RPG) PlayerUse(p *Player, z *Zone, params ActionParams) {
 	if needsUpdate {
 		g.Zones.SetDirty(z.Id)
 	}
+
+	if err != nil {
+		return ErrActionFailed
+	}
+	return nil
 }
@@ -2,28 +2,28 @@ package rpg
 
 import "log"
 
-func (g *RPG) PlayerTakeItem(p *Player, z *Zone, params ActionParams) {
+func (g *RPG) PlayerTakeItem(p *Player, z *Zone, params ActionParams) error {
 	itemId, ok := params.getInt("id")
 	if !ok {
 		log.Println("couldn't find item id param")
-		return
+		return ErrInvalidParams
 	}
 
 	item, ok := g.Items.GetInZone(itemId, z.Id)
 	if !ok {
 		log.Printf("[rpg/zone/%s/take_item] couldn't find item %d", z.Name, itemId)
-		return
+		return ErrUnknownItem
 	}
 
 	if !nextTo(p.X, p.Y, item.X, item.Y) {
 		log.Printf("[rpg/zone/%s/take_item] player %d tried to take item %d but was too far away", z.Name, p.Id, itemId)
-		return
+		return ErrOutOfRange
 	}
 
 	log.Printf("[rpg/zone/%s/take_item] grabbing item %d", z.Name, itemId)
 
 	if !p.CheckAPCost(1) {
-		return
+		return ErrNotEnoughAP
 	}
 
 	item.Give(p)
@@ -32,41 +32,50 @@ func (g *RPG) PlayerTakeItem(p *Player, z *Zone, params ActionParams) {
 	g.BuildPlayer(p)
 
 	g.Zones.SetDirty(z.Id)
+	return nil
 }
 
-func (g *RPG) PlayerEquipItem(p *Player, zone *Zone, params ActionParams) {
+func (g *RPG) PlayerEquipItem(p *Player, zone *Zone, params ActionParams) error {
 	itemId, ok := params.getInt("id")
 	if !ok {
 		log.Println("couldn't find item id param")
-		return
+		return ErrInvalidParams
 	}
 
 	if !p.CheckAPCost(1) {
-		return
+		return ErrNotEnoughAP
 	}
-	g.EquipItem(p, itemId)
+	equipped := g.EquipItem(p, itemId)
 	g.BuildPlayer(p)
+	if !equipped {
+		return ErrUnknownItem
+	}
+	return nil
 }
 
-func (g *RPG) PlayerUnequipItem(p *Player, zone *Zone, params ActionParams) {
+func (g *RPG) PlayerUnequipItem(p *Player, zone *Zone, params ActionParams) error {
 	slot, ok := params.getString("slot")
 	if !ok {
 		log.Println("couldn't find item slot param")
-		return
+		return ErrInvalidParams
 	}
 
 	if !p.CheckAPCost(1) {
-		return
+		return ErrNotEnoughAP
 	}
-	g.UnequipItem(p, slot)
+	unequipped := g.UnequipItem(p, slot)
 	g.BuildPlayer(p)
+	if !unequipped {
+		return ErrUnknownItem
+	}
+	return nil
 }
 
-func (g *RPG) PlayerDropItem(p *Player, zone *Zone, params ActionParams) {
+func (g *RPG) PlayerDropItem(p *Player, zone *Zone, params ActionParams) error {
 	itemId, ok := params.getInt("id")
 	if !ok {
 		log.Println("couldn't find item id param")
-		return
+		return ErrInvalidParams
 	}
 
 	dropped := g.DropItem(zone, p, itemId)
@@ -74,4 +83,8 @@ func (g *RPG) PlayerDropItem(p *Player, zone *Zone, params ActionParams) {
 		g.Zones.SetDirty(zone.Id)
 	}
 	g.BuildPlayer(p)
+	if !dropped {
+		return ErrUnknownItem
+	}
+	return nil
 }
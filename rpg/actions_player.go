@@ -1,9 +1,9 @@
 package rpg
 
-func (g *RPG) PlayerMove(p *Player, z *Zone, params ActionParams) {
+func (g *RPG) PlayerMove(p *Player, z *Zone, params ActionParams) error {
 	direction, ok := params["direction"].(string)
 	if !ok {
-		return
+		return ErrInvalidParams
 	}
 
 	var x int
@@ -15,22 +15,24 @@ func (g *RPG) PlayerMove(p *Player, z *Zone, params ActionParams) {
 	}
 
 	if !ok {
-		return
+		return ErrBlocked
 	}
 
 	if !p.CheckAPCost(1) {
-		return
+		return ErrNotEnoughAP
 	}
 	p.X = x
 	p.Y = y
 	g.Zones.SetDirty(z.Id)
+	return nil
 }
 
-func (g *RPG) PlayerFace(p *Player, z *Zone, params ActionParams) {
+func (g *RPG) PlayerFace(p *Player, z *Zone, params ActionParams) error {
 	direction, ok := params.getString("direction")
 	if !ok || !ValidFace(direction) {
-		return
+		return ErrInvalidParams
 	}
 	p.Facing = direction
 	g.Zones.SetDirty(z.Id)
+	return nil
 }
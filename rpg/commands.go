@@ -0,0 +1,85 @@
+package rpg
+
+import "log"
+
+// Internal actions behind the chat commands, they're sent by the server
+// rather than straight from a client so they skip the turn checks.
+
+// PlayerUnstuck sends a player back to zone 1, it can't be used to get out
+// of a fight.
+func (g *RPG) PlayerUnstuck(id int) error {
+	p := g.Players.Get(id)
+	if z, ok := g.Zones.Get(p.CurrentZone); ok && z.CombatInfo.InCombat {
+		return ErrBlocked
+	}
+	return g.PlayerTeleport(id, ActionParams{"zone": float64(1)})
+}
+
+// SpawnNPC creates an NPC on a free tile next to the player.
+func (g *RPG) SpawnNPC(id int, params ActionParams) error {
+	npcType, ok := params.getString("type")
+	if !ok {
+		return ErrInvalidParams
+	}
+	if _, ok := g.Defs.NPCs[npcType]; !ok {
+		return ErrUnknownTarget
+	}
+
+	p := g.Players.Get(id)
+	z, ok := g.Zones.Get(p.CurrentZone)
+	if !ok {
+		return ErrActionFailed
+	}
+
+	for _, dir := range []string{"N", "E", "S", "W"} {
+		x, y, free := z.Move(p.X, p.Y, dir)
+		if !free {
+			continue
+		}
+		npc, err := g.NewNPC(z, npcType, x, y)
+		if err != nil {
+			continue
+		}
+		log.Printf("[rpg/zone/%s/spawn] %s spawned %s at %d,%d", z.Name, p.Name, npc.Type, x, y)
+		g.CheckCombat(z)
+		g.Zones.SetDirty(z.Id)
+		g.Outgoing <- OutgoingMessage{
+			Zone: z.Id,
+			Type: ACTION_UPDATE,
+		}
+		return nil
+	}
+
+	return ErrBlocked
+}
+
+// GiveItem creates a new item and puts it in the player's inventory.
+func (g *RPG) GiveItem(id int, params ActionParams) error {
+	itemType, ok := params.getString("type")
+	if !ok {
+		return ErrInvalidParams
+	}
+	def, ok := g.Defs.Items[itemType]
+	if !ok {
+		return ErrUnknownItem
+	}
+
+	item := g.Items.New(def)
+
+	p := g.Players.Get(id)
+	item.Give(p)
+	g.Items.Save(item)
+	g.BuildPlayer(p)
+	g.Players.SetDirty(id)
+
+	if z, ok := g.Zones.Get(p.CurrentZone); ok {
+		if _, online := z.Players[id]; online {
+			g.Outgoing <- OutgoingMessage{
+				PlayerId: id,
+				Zone:     z.Id,
+				Type:     ACTION_UPDATE,
+			}
+		}
+	}
+	return nil
+}
@@ -1,7 +1,6 @@
 package rpg
 
 import (
-	"database/sql"
 	"database/sql/driver"
 	"encoding/json"
 	"errors"
@@ -35,42 +34,40 @@ func (d *Item) Scan(src interface{}) error {
 
 type ItemDB struct {
 	log   *log.Logger
-	DB    *sql.DB
 	items map[int]Item
+	dirty map[int]bool
+	// new items are numbered from here, the store only finds out about
+	// them with the next commit
+	lastId int
 }
 
-func NewItemDB(db *sql.DB) *ItemDB {
+func NewItemDB(store Store) (*ItemDB, error) {
 	itemDB := ItemDB{
 		log:   log.New(os.Stdout, "[RPG/ItemDB] ", log.LstdFlags),
-		DB:    db,
-		items: make(map[int]Item),
+		dirty: make(map[int]bool),
 	}
 
 	itemDB.log.Printf("Loading items from DB...")
-	rows, err := db.Query(`SELECT id, data FROM items`)
-
+	items, err := store.LoadItems()
 	if err != nil {
-		itemDB.log.Fatalf("Couldn't load items, SQL Error: %v", err)
+		return nil, fmt.Errorf("couldn't load items: %v", err)
 	}
-
-	for rows.Next() {
-		var id int
-		var item Item
-		if err := rows.Scan(&id, &item); err != nil {
-			itemDB.log.Printf("SQL Error: %v", err)
-			continue
+	itemDB.items = items
+	for id := range items {
+		if id > itemDB.lastId {
+			itemDB.lastId = id
 		}
-		item.Id = id
-		itemDB.items[id] = item
-		itemDB.log.Printf("Loaded item %d: %s", id, item.Name)
 	}
+	itemDB.log.Printf("Loaded %d items", len(items))
 
-	return &itemDB
+	return &itemDB, nil
 }
 
-func (db *ItemDB) New(def ItemDef) (Item, bool) {
+func (db *ItemDB) New(def ItemDef) Item {
 	db.log.Printf("Creating new item %s", def.Name)
+	db.lastId += 1
 	item := Item{
+		Id:         db.lastId,
 		Quality:    def.Quality,
 		Name:       def.Name,
 		Type:       def.Type,
@@ -80,15 +77,9 @@ func (db *ItemDB) New(def ItemDef) (Item, bool) {
 		Stats:      def.Stats,
 	}
 
-	err := db.DB.QueryRow(`INSERT INTO items (data) VALUES ($1) RETURNING id`, item).Scan(&item.Id)
-	if err != nil {
-		log.Printf("Failed to create new item, SQL error: %v", err)
-		return item, false
-	}
-
-	db.items[item.Id] = item
+	db.Save(item)
 
-	return item, true
+	return item
 }
 
 func (db *ItemDB) Get(id int) (Item, bool) {
@@ -154,15 +145,22 @@ func (db *ItemDB) LoadIntoZone(zone *Zone) {
 	}
 }
 
-func (db *ItemDB) Save(new Item) {
-	id := new.Id
-	oldItem := db.items[id]
-	db.log.Printf("Saving item %v", new)
-	_, err := db.DB.Exec(`UPDATE items SET data = $1 WHERE id = $2`, new, id)
-	if err != nil {
-		db.items[id] = oldItem
-		db.log.Printf("Failed to commit item old[%v] new[%v] changes, SQL Error: %v", oldItem, new, err)
-	} else {
-		db.items[id] = new
+// Save updates an item, it's written out with the next commit along with
+// the player or zone holding it.
+func (db *ItemDB) Save(item Item) {
+	db.items[item.Id] = item
+	db.dirty[item.Id] = true
+}
+
+// Unsaved returns the items changed since the last commit.
+func (db *ItemDB) Unsaved() []Item {
+	items := make([]Item, 0, len(db.dirty))
+	for id := range db.dirty {
+		items = append(items, db.items[id])
 	}
+	return items
+}
+
+func (db *ItemDB) Saved() {
+	db.dirty = make(map[int]bool)
 }
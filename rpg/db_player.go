@@ -1,7 +1,6 @@
 package rpg
 
 import (
-	"database/sql"
 	"database/sql/driver"
 	"encoding/json"
 	"errors"
@@ -35,44 +34,25 @@ func (d *Player) Scan(src interface{}) error {
 
 type PlayerDB struct {
 	log     *log.Logger
-	DB      *sql.DB
 	players map[int]*Player
 	dirty   map[int]bool
 }
 
-func NewPlayerDB(db *sql.DB) *PlayerDB {
+func NewPlayerDB(store Store) (*PlayerDB, error) {
 	playerDB := PlayerDB{
-		log:     log.New(os.Stdout, "[RPG/PlayerDB] ", log.LstdFlags),
-		DB:      db,
-		players: make(map[int]*Player),
-		dirty:   make(map[int]bool),
+		log:   log.New(os.Stdout, "[RPG/PlayerDB] ", log.LstdFlags),
+		dirty: make(map[int]bool),
 	}
 
 	playerDB.log.Printf("Loading players from DB...")
-	rows, err := db.Query(`SELECT id, data FROM players`)
-
+	players, err := store.LoadPlayers()
 	if err != nil {
-		playerDB.log.Fatalf("Couldn't load players, SQL error: %v", err)
-	}
-
-	for rows.Next() {
-		var id int
-		var p Player
-		if err := rows.Scan(&id, &p); err != nil {
-			if err == sql.ErrNoRows {
-				// if we don't find any rows, player must be new
-				p = Player{}
-			} else {
-				playerDB.log.Printf("SQL error: %v", err)
-				continue
-			}
-		}
-		p.Id = id
-		playerDB.players[id] = &p
-		playerDB.log.Printf("Loaded player %d", id)
+		return nil, fmt.Errorf("couldn't load players: %v", err)
 	}
+	playerDB.players = players
+	playerDB.log.Printf("Loaded %d players", len(players))
 
-	return &playerDB
+	return &playerDB, nil
 }
 
 func (db *PlayerDB) Get(id int) *Player {
@@ -90,16 +70,15 @@ func (db *PlayerDB) SetDirty(id int) {
 	db.dirty[id] = true
 }
 
-func (db *PlayerDB) Commit() {
+// Unsaved returns the players changed since the last commit.
+func (db *PlayerDB) Unsaved() []*Player {
+	players := make([]*Player, 0, len(db.dirty))
 	for id := range db.dirty {
-		p := db.players[id]
-		// db.log.Printf("Saving player %d:%s", id, p.Name)
-		_, err := db.DB.Exec(`UPDATE players SET data = $1 WHERE id = $2`, p, id)
-		if err != nil {
-			db.log.Printf("Failed update player[%v], SQL Error: %v", p, err)
-		}
+		players = append(players, db.players[id])
 	}
+	return players
+}
 
-	db.dirty = nil
+func (db *PlayerDB) Saved() {
 	db.dirty = make(map[int]bool)
 }
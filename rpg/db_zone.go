@@ -1,7 +1,6 @@
 package rpg
 
 import (
-	"database/sql"
 	"database/sql/driver"
 	"encoding/json"
 	"errors"
@@ -35,53 +34,46 @@ func (d *Zone) Scan(src interface{}) error {
 
 type ZoneDB struct {
 	log      *log.Logger
-	DB       *sql.DB
 	AllZones map[int]*Zone
-	dirty    map[int]bool
+	// dirty zones need an update sent, unsaved ones need committing
+	dirty   map[int]bool
+	unsaved map[int]bool
+	// new zones are numbered from here, the store only finds out about
+	// them with the next commit
+	lastId int
 }
 
-func NewZoneDB(db *sql.DB) *ZoneDB {
+func NewZoneDB(store Store) (*ZoneDB, error) {
 	zoneDB := ZoneDB{
-		log:      log.New(os.Stdout, "[RPG/ZoneDB] ", log.LstdFlags),
-		DB:       db,
-		AllZones: make(map[int]*Zone),
-		dirty:    make(map[int]bool),
+		log:     log.New(os.Stdout, "[RPG/ZoneDB] ", log.LstdFlags),
+		dirty:   make(map[int]bool),
+		unsaved: make(map[int]bool),
 	}
 
 	zoneDB.log.Printf("Loading zones from DB...")
-	rows, err := db.Query(`SELECT id, data FROM zones`)
-
+	zones, err := store.LoadZones()
 	if err != nil {
-		zoneDB.log.Fatalf("Couldn't load zones, SQL error: %v", err)
+		return nil, fmt.Errorf("couldn't load zones: %v", err)
 	}
-
-	for rows.Next() {
-		var id int
-		var z Zone
-		if err := rows.Scan(&id, &z); err != nil {
-			zoneDB.log.Printf("SQL error: %v", err)
-			continue
+	zoneDB.AllZones = zones
+	for id := range zones {
+		if id > zoneDB.lastId {
+			zoneDB.lastId = id
 		}
-		z.Id = id
-		zoneDB.AllZones[id] = &z
-		zoneDB.log.Printf("Loaded zone %d", id)
 	}
+	zoneDB.log.Printf("Loaded %d zones", len(zones))
 
-	return &zoneDB
+	return &zoneDB, nil
 }
 
-func (db *ZoneDB) Insert(zone *Zone) bool {
+// Insert gives a zone its id, it's saved with the next commit.
+func (db *ZoneDB) Insert(zone *Zone) {
 	db.log.Printf("Creating new zone")
 
-	err := db.DB.QueryRow(`INSERT INTO zones (data) VALUES ($1) RETURNING id`, zone).Scan(&zone.Id)
-	if err != nil {
-		log.Printf("Failed to create new zone, SQL error: %v", err)
-		return false
-	}
-
+	db.lastId += 1
+	zone.Id = db.lastId
 	db.AllZones[zone.Id] = zone
-
-	return true
+	db.unsaved[zone.Id] = true
 }
 
 func (db *ZoneDB) Get(id int) (*Zone, bool) {
@@ -89,8 +81,16 @@ func (db *ZoneDB) Get(id int) (*Zone, bool) {
 	return zone, ok
 }
 
+// SetDirty marks a zone as changed, it gets an update sent out on the next
+// tick and is saved with the next commit.
 func (db *ZoneDB) SetDirty(id int) {
 	db.dirty[id] = true
+	db.unsaved[id] = true
+}
+
+// SetUnsaved marks a zone to be saved without sending an update.
+func (db *ZoneDB) SetUnsaved(id int) {
+	db.unsaved[id] = true
 }
 
 func (db *ZoneDB) IsDirty(id int) bool {
@@ -98,15 +98,21 @@ func (db *ZoneDB) IsDirty(id int) bool {
 	return ok && dirty
 }
 
-func (db *ZoneDB) Commit() {
-	for id := range db.dirty {
-		z := db.AllZones[id]
-		_, err := db.DB.Exec(`UPDATE zones SET data = $1 WHERE id = $2`, z, id)
-		if err != nil {
-			db.log.Printf("Failed update zone[%v], SQL Error: %v", z, err)
-		}
+// ClearDirty is called once a tick's updates have gone out, zones stay
+// unsaved until they've been committed.
+func (db *ZoneDB) ClearDirty() {
+	db.dirty = make(map[int]bool)
+}
+
+// Unsaved returns the zones changed since the last commit.
+func (db *ZoneDB) Unsaved() []*Zone {
+	zones := make([]*Zone, 0, len(db.unsaved))
+	for id := range db.unsaved {
+		zones = append(zones, db.AllZones[id])
 	}
+	return zones
+}
 
-	db.dirty = nil
-	db.dirty = make(map[int]bool)
+func (db *ZoneDB) Saved() {
+	db.unsaved = make(map[int]bool)
 }
@@ -0,0 +1,161 @@
+package rpg
+
+import "reflect"
+
+// DisplayDelta is the difference between two DisplayData snapshots of the
+// same zone, Player is only set if the player's own info changed.
+type DisplayDelta struct {
+	Zone   ZoneDelta   `json:"zone"`
+	Player *PlayerInfo `json:"player,omitempty"`
+}
+
+type ZoneDelta struct {
+	Id    int    `json:"id"`
+	Tiles []tile `json:"tiles,omitempty"`
+
+	AddedEntities   []EntityInfo `json:"addedEntities,omitempty"`
+	ChangedEntities []EntityInfo `json:"changedEntities,omitempty"`
+	RemovedEntities []int        `json:"removedEntities,omitempty"`
+
+	AddedPlayers   []PlayerInfo `json:"addedPlayers,omitempty"`
+	ChangedPlayers []PlayerInfo `json:"changedPlayers,omitempty"`
+	RemovedPlayers []int        `json:"removedPlayers,omitempty"`
+
+	AddedNPCs   []NPCInfo `json:"addedNPCs,omitempty"`
+	ChangedNPCs []NPCInfo `json:"changedNPCs,omitempty"`
+	RemovedNPCs []int     `json:"removedNPCs,omitempty"`
+
+	AddedItems   []ItemInfo `json:"addedItems,omitempty"`
+	ChangedItems []ItemInfo `json:"changedItems,omitempty"`
+	RemovedItems []int      `json:"removedItems,omitempty"`
+
+	// combat info is small, so it's always sent in full
+	InCombat          bool         `json:"inCombat"`
+	CurrentInitiative int          `json:"currentInitiative"`
+	Combatants        []CombatInfo `json:"combatants"`
+}
+
+// CanDiff reports whether new can be sent as a delta against old, editors
+// and zone changes always get a full snapshot.
+func CanDiff(old, new DisplayData) bool {
+	return old.Zone.Id == new.Zone.Id &&
+		old.Zone.Name == new.Zone.Name &&
+		old.Defs == nil && new.Defs == nil
+}
+
+// DiffDisplayData builds the delta from old to new, the second return value
+// is false if nothing changed and there's no need to send anything.
+func DiffDisplayData(old, new DisplayData) (DisplayDelta, bool) {
+	delta := DisplayDelta{Zone: diffZone(old.Zone, new.Zone)}
+	if !reflect.DeepEqual(old.Player, new.Player) {
+		player := new.Player
+		delta.Player = &player
+	}
+	combatChanged := old.Zone.InCombat != new.Zone.InCombat ||
+		old.Zone.CurrentInitiative != new.Zone.CurrentInitiative ||
+		!reflect.DeepEqual(old.Zone.Combatants, new.Zone.Combatants)
+	return delta, combatChanged || !delta.empty()
+}
+
+func (d DisplayDelta) empty() bool {
+	z := d.Zone
+	return d.Player == nil &&
+		len(z.Tiles) == 0 &&
+		len(z.AddedEntities) == 0 && len(z.ChangedEntities) == 0 && len(z.RemovedEntities) == 0 &&
+		len(z.AddedPlayers) == 0 && len(z.ChangedPlayers) == 0 && len(z.RemovedPlayers) == 0 &&
+		len(z.AddedNPCs) == 0 && len(z.ChangedNPCs) == 0 && len(z.RemovedNPCs) == 0 &&
+		len(z.AddedItems) == 0 && len(z.ChangedItems) == 0 && len(z.RemovedItems) == 0
+}
+
+func diffZone(old, new ZoneDisplayData) ZoneDelta {
+	delta := ZoneDelta{
+		Id:                new.Id,
+		InCombat:          new.InCombat,
+		CurrentInitiative: new.CurrentInitiative,
+		Combatants:        new.Combatants,
+	}
+
+	oldTiles := make(map[uint64]tile)
+	for _, t := range old.Map {
+		oldTiles[compactCoords(t.X, t.Y)] = t
+	}
+	for _, t := range new.Map {
+		if o, ok := oldTiles[compactCoords(t.X, t.Y)]; !ok || o.Tile != t.Tile {
+			delta.Tiles = append(delta.Tiles, t)
+		}
+	}
+
+	oldEntities := make(map[int]EntityInfo)
+	for _, e := range old.Entities {
+		oldEntities[e.Id] = e
+	}
+	for _, e := range new.Entities {
+		if o, ok := oldEntities[e.Id]; !ok {
+			delta.AddedEntities = append(delta.AddedEntities, e)
+		} else {
+			if !reflect.DeepEqual(o, e) {
+				delta.ChangedEntities = append(delta.ChangedEntities, e)
+			}
+			delete(oldEntities, e.Id)
+		}
+	}
+	for id := range oldEntities {
+		delta.RemovedEntities = append(delta.RemovedEntities, id)
+	}
+
+	oldPlayers := make(map[int]PlayerInfo)
+	for _, p := range old.Players {
+		oldPlayers[p.Id] = p
+	}
+	for _, p := range new.Players {
+		if o, ok := oldPlayers[p.Id]; !ok {
+			delta.AddedPlayers = append(delta.AddedPlayers, p)
+		} else {
+			if !reflect.DeepEqual(o, p) {
+				delta.ChangedPlayers = append(delta.ChangedPlayers, p)
+			}
+			delete(oldPlayers, p.Id)
+		}
+	}
+	for id := range oldPlayers {
+		delta.RemovedPlayers = append(delta.RemovedPlayers, id)
+	}
+
+	oldNPCs := make(map[int]NPCInfo)
+	for _, n := range old.NPCs {
+		oldNPCs[n.Id] = n
+	}
+	for _, n := range new.NPCs {
+		if o, ok := oldNPCs[n.Id]; !ok {
+			delta.AddedNPCs = append(delta.AddedNPCs, n)
+		} else {
+			if o != n {
+				delta.ChangedNPCs = append(delta.ChangedNPCs, n)
+			}
+			delete(oldNPCs, n.Id)
+		}
+	}
+	for id := range oldNPCs {
+		delta.RemovedNPCs = append(delta.RemovedNPCs, id)
+	}
+
+	oldItems := make(map[int]ItemInfo)
+	for _, i := range old.Items {
+		oldItems[i.Id] = i
+	}
+	for _, i := range new.Items {
+		if o, ok := oldItems[i.Id]; !ok {
+			delta.AddedItems = append(delta.AddedItems, i)
+		} else {
+			if o != i {
+				delta.ChangedItems = append(delta.ChangedItems, i)
+			}
+			delete(oldItems, i.Id)
+		}
+	}
+	for id := range oldItems {
+		delta.RemovedItems = append(delta.RemovedItems, id)
+	}
+
+	return delta
+}
@@ -0,0 +1,116 @@
+package rpg
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestDiffDisplayData(t *testing.T) {
+	base := func() DisplayData {
+		return DisplayData{
+			Zone: ZoneDisplayData{
+				Id:      1,
+				Map:     []tile{{Tile: 1, X: 0, Y: 0}, {Tile: 1, X: 1, Y: 0}},
+				Players: []PlayerInfo{{Id: 1, Name: "a"}, {Id: 2, Name: "b"}},
+				NPCs:    []NPCInfo{{Id: 1, HP: 10}},
+				Items:   []ItemInfo{{Id: 1, Name: "sword"}},
+			},
+			Player: PlayerInfo{Id: 1, Name: "a"},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		change  func(d *DisplayData)
+		changed bool
+		check   func(t *testing.T, delta DisplayDelta)
+	}{
+		{"nothing changed", func(d *DisplayData) {}, false, nil},
+		{"tile changed", func(d *DisplayData) { d.Zone.Map[1].Tile = 2 }, true,
+			func(t *testing.T, delta DisplayDelta) {
+				if len(delta.Zone.Tiles) != 1 || delta.Zone.Tiles[0].X != 1 {
+					t.Errorf("tiles = %v, want just the changed one", delta.Zone.Tiles)
+				}
+			}},
+		{"player added and removed", func(d *DisplayData) {
+			d.Zone.Players = []PlayerInfo{{Id: 1, Name: "a"}, {Id: 3, Name: "c"}}
+		}, true, func(t *testing.T, delta DisplayDelta) {
+			if len(delta.Zone.AddedPlayers) != 1 || delta.Zone.AddedPlayers[0].Id != 3 {
+				t.Errorf("added = %v, want player 3", delta.Zone.AddedPlayers)
+			}
+			if !reflect.DeepEqual(delta.Zone.RemovedPlayers, []int{2}) {
+				t.Errorf("removed = %v, want [2]", delta.Zone.RemovedPlayers)
+			}
+			if len(delta.Zone.ChangedPlayers) != 0 {
+				t.Errorf("changed = %v, want none", delta.Zone.ChangedPlayers)
+			}
+		}},
+		{"npc changed", func(d *DisplayData) { d.Zone.NPCs[0].HP = 5 }, true,
+			func(t *testing.T, delta DisplayDelta) {
+				if len(delta.Zone.ChangedNPCs) != 1 || delta.Zone.ChangedNPCs[0].HP != 5 {
+					t.Errorf("changed npcs = %v", delta.Zone.ChangedNPCs)
+				}
+			}},
+		{"items removed", func(d *DisplayData) { d.Zone.Items = nil }, true,
+			func(t *testing.T, delta DisplayDelta) {
+				sort.Ints(delta.Zone.RemovedItems)
+				if !reflect.DeepEqual(delta.Zone.RemovedItems, []int{1}) {
+					t.Errorf("removed items = %v", delta.Zone.RemovedItems)
+				}
+			}},
+		{"own player changed", func(d *DisplayData) { d.Player.Name = "renamed" }, true,
+			func(t *testing.T, delta DisplayDelta) {
+				if delta.Player == nil || delta.Player.Name != "renamed" {
+					t.Errorf("player = %v, want the new info", delta.Player)
+				}
+			}},
+		{"combat only", func(d *DisplayData) { d.Zone.InCombat = true }, true,
+			func(t *testing.T, delta DisplayDelta) {
+				if !delta.Zone.InCombat {
+					t.Errorf("delta doesn't say the zone's in combat")
+				}
+			}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			old, new := base(), base()
+			test.change(&new)
+			delta, changed := DiffDisplayData(old, new)
+			if changed != test.changed {
+				t.Fatalf("changed = %v, want %v", changed, test.changed)
+			}
+			if delta.Player != nil && !test.changed {
+				t.Errorf("unchanged player was sent")
+			}
+			if test.check != nil {
+				test.check(t, delta)
+			}
+		})
+	}
+}
+
+func TestCanDiff(t *testing.T) {
+	zone := func(id int, name string) DisplayData {
+		return DisplayData{Zone: ZoneDisplayData{Id: id, Name: name}}
+	}
+	editor := zone(1, "a")
+	editor.Defs = &Definitions{}
+
+	tests := []struct {
+		name     string
+		old, new DisplayData
+		want     bool
+	}{
+		{"same zone", zone(1, "a"), zone(1, "a"), true},
+		{"changed zone", zone(1, "a"), zone(2, "a"), false},
+		{"renamed zone", zone(1, "a"), zone(1, "b"), false},
+		{"editor", zone(1, "a"), editor, false},
+	}
+	for _, test := range tests {
+		if got := CanDiff(test.old, test.new); got != test.want {
+			t.Errorf("%s: CanDiff = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -5,17 +5,17 @@ import (
 	"strings"
 )
 
-func (g *RPG) HandleEdit(player *Player, zone *Zone, params ActionParams) {
+func (g *RPG) HandleEdit(player *Player, zone *Zone, params ActionParams) error {
 	log.Printf("START EDIT IN %s", zone.Name)
 
 	editType, ok := params.getString("type")
 	if !ok {
 		log.Printf("EDIT FAILED: MISSING TYPE")
-		return
+		return ErrInvalidEditParam
 	}
 
 	if !player.Editing && editType != "enable" {
-		return
+		return ErrNotEditing
 	}
 
 	updated := false
@@ -30,16 +30,12 @@ func (g *RPG) HandleEdit(player *Player, zone *Zone, params ActionParams) {
 		player.Editing = false
 		log.Printf("%s DISABLED", player.Name)
 		updated = true
-		return
+		return nil
 	case "zone_create":
 		log.Printf("EDIT TYPE: CREATE ZONE")
 		newZone := &Zone{Name: "unnamed"}
 		g.InitZone(newZone)
-		ok := g.Zones.Insert(newZone)
-		if !ok {
-			log.Printf("EDIT FAILED: CAN'T CREATE ZONE")
-			return
-		}
+		g.Zones.Insert(newZone)
 		g.RemovePlayer(zone, player)
 		g.AddPlayer(newZone, player, 0, 0)
 		g.Zones.SetDirty(newZone.Id)
@@ -53,12 +49,12 @@ func (g *RPG) HandleEdit(player *Player, zone *Zone, params ActionParams) {
 		to, ok := params.getInt("zone")
 		if !ok {
 			log.Printf("EDIT FAILED: INVALID ZONE ID")
-			return
+			return ErrInvalidEditParam
 		}
 		newZone, ok := g.Zones.Get(to)
 		if !ok {
 			log.Printf("EDIT FAILED: INVALID ZONE")
-			return
+			return ErrInvalidEditParam
 		}
 		g.RemovePlayer(zone, player)
 		g.AddPlayer(newZone, player, -1, -1)
@@ -73,17 +69,17 @@ func (g *RPG) HandleEdit(player *Player, zone *Zone, params ActionParams) {
 		x, ok := params.getInt("x")
 		if !ok {
 			log.Printf("EDIT FAILED: INVALID X")
-			return
+			return ErrInvalidEditParam
 		}
 		y, ok := params.getInt("y")
 		if !ok {
 			log.Printf("EDIT FAILED: INVALID Y")
-			return
+			return ErrInvalidEditParam
 		}
 		to, ok := params.getInt("to")
 		if !ok || to < 0 || to >= len(g.Defs.Tiles) {
 			log.Printf("EDIT FAILED: INVALID TILE ID")
-			return
+			return ErrInvalidEditParam
 		}
 		tile := g.Defs.Tiles[to]
 		zone.Map.SetTile(x, y, tile)
@@ -94,54 +90,54 @@ func (g *RPG) HandleEdit(player *Player, zone *Zone, params ActionParams) {
 		entType, ok := params.getString("ent")
 		if !ok {
 			log.Printf("EDIT FAILED: INVALID TYPE")
-			return
+			return ErrInvalidEditParam
 		}
 		x, ok := params.getInt("x")
 		if !ok {
 			log.Printf("EDIT FAILED: INVALID X")
-			return
+			return ErrInvalidEditParam
 		}
 		y, ok := params.getInt("y")
 		if !ok {
 			log.Printf("EDIT FAILED: INVALID Y")
-			return
+			return ErrInvalidEditParam
 		}
 		if _, err := g.AddEntity(zone, entType, x, y, true); err != nil {
 			log.Printf("EDIT FAILED: %v", err)
-		} else {
-			updated = true
+			return ErrInvalidEditParam
 		}
+		updated = true
 	case "entity_edit":
 		log.Printf("EDIT TYPE: EDIT ENTITY")
 		entId, ok := params.getInt("ent")
 		if !ok {
 			log.Printf("EDIT FAILED: INVALID ID")
-			return
+			return ErrInvalidEditParam
 		}
 		ent, ok := zone.Entities[entId]
 		if !ok {
 			log.Printf("EDIT FAILED: INVALID ENTITY")
-			return
+			return ErrInvalidEditParam
 		}
 		name, ok := params.getString("name")
 		if !ok {
 			log.Printf("EDIT FAILED: INVALID NAME")
-			return
+			return ErrInvalidEditParam
 		}
 		x, ok := params.getInt("x")
 		if !ok {
 			log.Printf("EDIT FAILED: INVALID X")
-			return
+			return ErrInvalidEditParam
 		}
 		y, ok := params.getInt("y")
 		if !ok {
 			log.Printf("EDIT FAILED: INVALID Y")
-			return
+			return ErrInvalidEditParam
 		}
 		rotation, ok := params.getInt("rotation")
 		if !ok {
 			log.Printf("EDIT FAILED: INVALID ROTATION")
-			return
+			return ErrInvalidEditParam
 		}
 
 		if len(name) > 0 {
@@ -169,11 +165,11 @@ func (g *RPG) HandleEdit(player *Player, zone *Zone, params ActionParams) {
 		entId, ok := params.getInt("ent")
 		if !ok {
 			log.Printf("EDIT FAILED: INVALID ID")
-			return
+			return ErrInvalidEditParam
 		}
 		if _, ok := zone.Entities[entId]; !ok {
 			log.Printf("EDIT FAILED: INVALID ENTITY")
-			return
+			return ErrInvalidEditParam
 		}
 
 		g.RemoveEntity(zone, entId)
@@ -193,6 +189,9 @@ func (g *RPG) HandleEdit(player *Player, zone *Zone, params ActionParams) {
 		}
 
 		updated = true
+	default:
+		log.Printf("EDIT FAILED: UNKNOWN TYPE %s", editType)
+		return ErrInvalidEditParam
 	}
 
 	log.Printf("EDIT SUCCESS: %v", updated)
@@ -204,4 +203,6 @@ func (g *RPG) HandleEdit(player *Player, zone *Zone, params ActionParams) {
 			Type: ACTION_UPDATE,
 		}
 	}
+
+	return nil
 }
@@ -0,0 +1,26 @@
+package rpg
+
+// ActionError is why a player's action was rejected. The server maps these
+// onto its ClientError codes before sending them to the player.
+type ActionError struct {
+	Reason string
+}
+
+func (e *ActionError) Error() string {
+	return "rpg: " + e.Reason
+}
+
+var (
+	ErrNotYourTurn      = &ActionError{"not_your_turn"}
+	ErrOutOfRange       = &ActionError{"out_of_range"}
+	ErrNotEnoughAP      = &ActionError{"not_enough_ap"}
+	ErrUnknownItem      = &ActionError{"unknown_item"}
+	ErrUnknownTarget    = &ActionError{"unknown_target"}
+	ErrInvalidParams    = &ActionError{"invalid_params"}
+	ErrBlocked          = &ActionError{"blocked"}
+	ErrActionFailed     = &ActionError{"action_failed"}
+	ErrInvalidEditParam = &ActionError{"invalid_edit_param"}
+	ErrNotEditing       = &ActionError{"not_editing"}
+	ErrShuttingDown     = &ActionError{"shutting_down"}
+	ErrSavingBehind     = &ActionError{"saving_behind"}
+)
@@ -18,6 +18,8 @@ type PlayerInfo struct {
 	Stats  StatBlock  `json:"stats,omitempty"`
 	Level  int        `json:"level"`
 	Skills SkillBlock `json:"skills,omitempty"`
+
+	Linkdead bool `json:"linkdead,omitempty"`
 }
 
 func (p *Player) GetInfo(base *RPG) PlayerInfo {
@@ -49,20 +51,22 @@ func (p *Player) GetInfo(base *RPG) PlayerInfo {
 		Stats:     p.Stats,
 		Skills:    p.Skills,
 		Level:     p.Skills.TotalLevel(),
+		Linkdead:  p.Linkdead,
 	}
 }
 
 func (p Player) GetInfoPublic(base *RPG) PlayerInfo {
 	return PlayerInfo{
-		Id:     p.Id,
-		Name:   p.Name,
-		Slots:  p.GetSlotInfo(base),
-		X:      p.X,
-		Y:      p.Y,
-		Facing: p.Facing,
-		HP:     p.HP,
-		MaxHP:  p.Stats.MaxHP,
-		Level:  p.Skills.TotalLevel(),
+		Id:       p.Id,
+		Name:     p.Name,
+		Slots:    p.GetSlotInfo(base),
+		X:        p.X,
+		Y:        p.Y,
+		Facing:   p.Facing,
+		HP:       p.HP,
+		MaxHP:    p.Stats.MaxHP,
+		Level:    p.Skills.TotalLevel(),
+		Linkdead: p.Linkdead,
 	}
 }
 
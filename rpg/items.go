@@ -46,11 +46,7 @@ func (g *RPG) AddItem(z *Zone, itemType string, x, y int) (Item, error) {
 		return Item{}, errors.New("item doesn't exist")
 	}
 
-	item, ok := g.Items.New(def)
-	if !ok {
-		log.Printf("[rpg/zone/%s/createitem] error creating item '%s'", z.Name, itemType)
-		return Item{}, nil
-	}
+	item := g.Items.New(def)
 
 	item.X = x
 	item.Y = y
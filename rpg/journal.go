@@ -0,0 +1,275 @@
+package rpg
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Journal is an append-only log of every snapshot handed to the persister,
+// so anything the store never got can be recovered after a crash. It's
+// written by its own goroutine, batches queued while it's syncing go out
+// together with a single fsync, so the game loop never waits on the disk.
+//
+// The store checkpoints it after every write. Whatever the store already
+// has is dropped, the file is rotated to path.old until the next write
+// covers the rest, so it only ever holds a couple of writes' worth of
+// changes, or everything since the store went down while it's down.
+//
+// The rows each action produced are journalled rather than the actions
+// themselves, replaying actions wouldn't roll the same dice or give NPCs
+// the same turns.
+type Journal struct {
+	log  *log.Logger
+	path string
+
+	mutex   sync.Mutex
+	queue   []journalEntry
+	covered int64
+	wake    chan bool
+	closed  bool
+	done    chan bool
+
+	// held while writing so a checkpoint can't rotate the file underneath
+	fileMutex sync.Mutex
+	file      *os.File
+	// last sequence number written to the current file and to path.old,
+	// hasOld is false once path.old is gone
+	lastSeq int64
+	oldSeq  int64
+	hasOld  bool
+}
+
+type journalEntry struct {
+	Seq   int64 `json:"seq"`
+	Time  int64 `json:"time"`
+	Batch Batch `json:"batch"`
+}
+
+// OpenJournal starts writing to path, ReplayJournal has to have run first.
+func OpenJournal(path string) (*Journal, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	j := &Journal{
+		log:  log.New(os.Stdout, "[RPG/Journal] ", log.LstdFlags),
+		path: path,
+		file: file,
+		wake: make(chan bool, 1),
+		done: make(chan bool),
+	}
+	go j.run()
+	return j, nil
+}
+
+func oldJournalPath(path string) string {
+	return path + ".old"
+}
+
+// Add queues a snapshot to be written, seq is the persister's sequence
+// number for it. It never blocks on the disk.
+func (j *Journal) Add(seq int64, b Batch) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.closed {
+		return
+	}
+	j.queue = append(j.queue, journalEntry{seq, time.Now().Unix(), b})
+	select {
+	case j.wake <- true:
+	default:
+	}
+}
+
+// Checkpoint drops everything up to seq, the store has it.
+func (j *Journal) Checkpoint(seq int64) {
+	j.mutex.Lock()
+	if seq > j.covered {
+		j.covered = seq
+	}
+	j.mutex.Unlock()
+
+	j.fileMutex.Lock()
+	defer j.fileMutex.Unlock()
+	if j.hasOld && j.oldSeq <= seq {
+		if err := os.Remove(oldJournalPath(j.path)); err != nil && !os.IsNotExist(err) {
+			j.log.Printf("couldn't remove %s: %v", oldJournalPath(j.path), err)
+			return
+		}
+		j.hasOld = false
+	}
+	if j.lastSeq <= seq {
+		if err := j.file.Truncate(0); err != nil {
+			j.log.Printf("couldn't truncate the journal: %v", err)
+		}
+		return
+	}
+	if j.hasOld {
+		// still waiting on the store for the old file, this one stays put
+		return
+	}
+	if err := j.rotate(); err != nil {
+		j.log.Printf("couldn't rotate the journal: %v", err)
+	}
+}
+
+// rotate must be called with fileMutex held.
+func (j *Journal) rotate() error {
+	if err := j.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(j.path, oldJournalPath(j.path)); err != nil {
+		return err
+	}
+	j.oldSeq = j.lastSeq
+	j.hasOld = true
+	file, err := os.OpenFile(j.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	j.file = file
+	return nil
+}
+
+// Close writes anything still queued and stops the writer.
+func (j *Journal) Close() error {
+	j.mutex.Lock()
+	j.closed = true
+	close(j.wake)
+	j.mutex.Unlock()
+	<-j.done
+
+	j.fileMutex.Lock()
+	defer j.fileMutex.Unlock()
+	return j.file.Close()
+}
+
+func (j *Journal) run() {
+	defer close(j.done)
+	for range j.wake {
+		j.write()
+	}
+	j.write()
+}
+
+// write takes everything queued and syncs it in one go, entries the store
+// already has are skipped.
+func (j *Journal) write() {
+	j.mutex.Lock()
+	queue := j.queue
+	covered := j.covered
+	j.queue = nil
+	j.mutex.Unlock()
+
+	j.fileMutex.Lock()
+	defer j.fileMutex.Unlock()
+
+	w := bufio.NewWriter(j.file)
+	last := j.lastSeq
+	for _, entry := range queue {
+		if entry.Seq <= covered {
+			continue
+		}
+		line, err := json.Marshal(entry)
+		if err != nil {
+			j.log.Printf("couldn't encode entry %d: %v", entry.Seq, err)
+			continue
+		}
+		w.Write(append(line, '\n'))
+		last = entry.Seq
+	}
+	if last == j.lastSeq {
+		return
+	}
+	if err := w.Flush(); err != nil {
+		j.log.Printf("WARNING: couldn't write to the journal: %v", err)
+		return
+	}
+	if err := j.file.Sync(); err != nil {
+		j.log.Printf("WARNING: couldn't sync the journal: %v", err)
+		return
+	}
+	j.lastSeq = last
+}
+
+// ReplayJournal commits whatever an unclean shutdown left in the journal,
+// newest rows winning, and empties it. Entries the store already has are
+// skipped, a checkpoint can be lost in a crash after the commit it was for,
+// and replaying them would put back rows older than the store's. It has to
+// run before the game loads from the store. Returns how many rows were
+// recovered.
+func ReplayJournal(path string, store Store) (int, error) {
+	committed, err := store.CommittedSeq()
+	if err != nil {
+		return 0, err
+	}
+	pending := newPendingRows()
+	entries := 0
+	last := committed
+	// the old file's from before the current one
+	for _, p := range []string{oldJournalPath(path), path} {
+		n, seq, err := readJournal(p, committed, pending)
+		if err != nil {
+			return 0, err
+		}
+		entries += n
+		if seq > last {
+			last = seq
+		}
+	}
+	if pending.len() > 0 {
+		log.Printf("[RPG/Journal] replaying %d rows from %d entries", pending.len(), entries)
+		batch := pending.batch()
+		batch.Seq = last
+		if err := store.Commit(batch); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := os.Remove(oldJournalPath(path)); err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	if err := os.Truncate(path, 0); err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	return pending.len(), nil
+}
+
+// readJournal merges the entries in path after committed into pending,
+// returning how many there were and the last one's sequence number.
+func readJournal(path string, committed int64, pending pendingRows) (int, int64, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	entries := 0
+	last := int64(0)
+	line := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		line++
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// the last line can be cut short by a crash mid write, it
+			// was never synced so there's nothing to lose
+			log.Printf("[RPG/Journal] skipping unreadable entry %d in %s: %v", line, path, err)
+			continue
+		}
+		if entry.Seq <= committed {
+			continue
+		}
+		pending.merge(entry.Batch, false)
+		entries++
+		last = entry.Seq
+	}
+	return entries, last, scanner.Err()
+}
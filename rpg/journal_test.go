@@ -0,0 +1,178 @@
+package rpg
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplayJournal(t *testing.T) {
+	tests := []struct {
+		name string
+		// the store starts with zone 1 at this seq
+		committed int64
+		old       string
+		current   string
+		recovered int
+		want      map[int]string
+		wantSeq   int64
+	}{
+		{"empty", 0, "", "", 0, map[int]string{}, 0},
+		{"truncated last line", 0, "",
+			`{"seq":1,"time":1,"batch":{"zones":[{"id":1,"data":"a"}]}}` + "\n" + `{"seq":2,"time":2,"batch":{"zo`,
+			1, map[int]string{1: `"a"`}, 1},
+		{"current file wins over old", 0,
+			`{"seq":1,"time":1,"batch":{"zones":[{"id":1,"data":"old"},{"id":2,"data":"b"}]}}` + "\n",
+			`{"seq":2,"time":2,"batch":{"zones":[{"id":1,"data":"new"}]}}` + "\n",
+			2, map[int]string{1: `"new"`, 2: `"b"`}, 2},
+		{"store newer than journal", 2,
+			`{"seq":1,"time":1,"batch":{"zones":[{"id":1,"data":"older"}]}}` + "\n",
+			`{"seq":2,"time":2,"batch":{"zones":[{"id":1,"data":"old"}]}}` + "\n" +
+				`{"seq":3,"time":3,"batch":{"zones":[{"id":2,"data":"b"}]}}` + "\n",
+			1, map[int]string{1: `"stored"`, 2: `"b"`}, 3},
+		{"store has everything", 2, "",
+			`{"seq":2,"time":2,"batch":{"zones":[{"id":1,"data":"old"}]}}` + "\n",
+			0, map[int]string{1: `"stored"`}, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "journal.jsonl")
+			if test.old != "" {
+				os.WriteFile(oldJournalPath(path), []byte(test.old), 0644)
+			}
+			os.WriteFile(path, []byte(test.current), 0644)
+
+			store := newFlakyStore()
+			if test.committed > 0 {
+				store.Commit(Batch{Zones: []Row{row(1, `"stored"`)}, Seq: test.committed})
+			}
+			n, err := ReplayJournal(path, store)
+			if err != nil {
+				t.Fatalf("ReplayJournal: %v", err)
+			}
+			if n != test.recovered {
+				t.Errorf("recovered %d rows, want %d", n, test.recovered)
+			}
+			for id, want := range test.want {
+				if got := store.zone(id); got != want {
+					t.Errorf("zone %d = %s, want %s", id, got, want)
+				}
+			}
+			if seq, _ := store.CommittedSeq(); seq != test.wantSeq {
+				t.Errorf("committed seq = %d, want %d", seq, test.wantSeq)
+			}
+			if info, err := os.Stat(path); err != nil || info.Size() != 0 {
+				t.Errorf("journal wasn't emptied")
+			}
+			if _, err := os.Stat(oldJournalPath(path)); !os.IsNotExist(err) {
+				t.Errorf("old journal wasn't removed")
+			}
+		})
+	}
+}
+
+func journalSize(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return 0
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func TestJournalCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	j, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	written := func(seq int64) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			j.fileMutex.Lock()
+			last := j.lastSeq
+			j.fileMutex.Unlock()
+			if last >= seq {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("entry %d was never written", seq)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	j.Add(1, Batch{Zones: []Row{row(1, `"a"`)}})
+	j.Add(2, Batch{Zones: []Row{row(1, `"b"`)}})
+	written(2)
+
+	// the store only has the first, the file's rotated to keep the second
+	j.Checkpoint(1)
+	if journalSize(t, oldJournalPath(path)) == 0 || journalSize(t, path) != 0 {
+		t.Fatalf("expected the journal to be rotated")
+	}
+
+	j.Add(3, Batch{Zones: []Row{row(1, `"c"`)}})
+	written(3)
+	// covers the old file but not the current one, which takes its place
+	j.Checkpoint(2)
+	if journalSize(t, oldJournalPath(path)) == 0 || journalSize(t, path) != 0 {
+		t.Errorf("entry 3 isn't in the store yet and should have been rotated")
+	}
+
+	j.Checkpoint(3)
+	if journalSize(t, path) != 0 || journalSize(t, oldJournalPath(path)) != 0 {
+		t.Errorf("journal should be empty once the store has everything")
+	}
+
+	// entries the store already has by the time they're written are skipped
+	j.Add(3, Batch{Zones: []Row{row(1, `"c"`)}})
+	j.Add(4, Batch{Zones: []Row{row(1, `"d"`)}})
+	written(4)
+	data, _ := os.ReadFile(path)
+	if got := strings.Count(string(data), "\n"); got != 1 {
+		t.Errorf("journal has %d entries, want only the uncovered one", got)
+	}
+}
+
+func TestPersisterDoesntWaitOnTheJournal(t *testing.T) {
+	j, err := OpenJournal(filepath.Join(t.TempDir(), "journal.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newFlakyStore()
+	p := NewPersister(store, j, 0)
+
+	// a stuck fsync, the checkpoint after the commit waits on it
+	j.fileMutex.Lock()
+	p.Queue(Batch{Zones: []Row{row(1, `"a"`)}})
+	for store.zone(1) != `"a"` {
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan bool)
+	go func() {
+		p.Queue(Batch{Zones: []Row{row(1, `"b"`)}})
+		p.Stats()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the persister waited on the journal")
+	}
+
+	j.fileMutex.Unlock()
+	if err := p.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if got := store.zone(1); got != `"b"` {
+		t.Errorf("stored %s, want the newer row", got)
+	}
+}
@@ -0,0 +1,76 @@
+package rpg
+
+import (
+	"sync"
+	"time"
+)
+
+// Timing keeps running totals for something that happens repeatedly, it's
+// safe to read from other goroutines.
+type Timing struct {
+	mutex sync.Mutex
+	count int64
+	total time.Duration
+	last  time.Duration
+	at    time.Time
+}
+
+type TimingStats struct {
+	Count int64
+	Total time.Duration
+	Last  time.Duration
+	At    time.Time
+}
+
+func (t *Timing) Record(start time.Time) {
+	now := time.Now()
+	t.mutex.Lock()
+	t.count += 1
+	t.last = now.Sub(start)
+	t.total += t.last
+	t.at = now
+	t.mutex.Unlock()
+}
+
+func (t *Timing) Stats() TimingStats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return TimingStats{t.count, t.total, t.last, t.at}
+}
+
+type ZoneStats struct {
+	Id       int
+	Name     string
+	Players  int
+	InCombat bool
+	// ids of the players in the zone, including linkdead ones
+	PlayerIds []int
+}
+
+// updateZoneStats copies what the metrics need out of the zones, since
+// they can only be touched from the game loop.
+func (g *RPG) updateZoneStats() {
+	stats := make([]ZoneStats, 0, len(g.Zones.AllZones))
+	for id, z := range g.Zones.AllZones {
+		playerIds := make([]int, 0, len(z.Players))
+		for pId := range z.Players {
+			playerIds = append(playerIds, pId)
+		}
+		stats = append(stats, ZoneStats{
+			Id:        id,
+			Name:      z.Name,
+			Players:   len(z.Players),
+			InCombat:  z.CombatInfo.InCombat,
+			PlayerIds: playerIds,
+		})
+	}
+	g.statsMutex.Lock()
+	g.zoneStats = stats
+	g.statsMutex.Unlock()
+}
+
+func (g *RPG) ZoneStats() []ZoneStats {
+	g.statsMutex.Lock()
+	defer g.statsMutex.Unlock()
+	return g.zoneStats
+}
@@ -0,0 +1,308 @@
+package rpg
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// how long to wait after a failed commit before trying again
+	COMMIT_RETRY_INTERVAL = 5 * time.Second
+	// how far the store's allowed to fall behind the game, past it player
+	// actions are refused until a write goes through
+	MAX_PERSIST_LAG = 30 * time.Second
+	// how many times Close tries to write what's left before giving up
+	CLOSE_ATTEMPTS = 3
+)
+
+// Persister writes snapshots to the store in the background so the game
+// loop never waits on it. Snapshots queued while a write is in flight are
+// merged, newest wins, so however far behind the store gets there's at most
+// one pending row per player, zone and item.
+type Persister struct {
+	log     *log.Logger
+	store   Store
+	journal *Journal
+
+	mutex   sync.Mutex
+	pending pendingRows
+	// when the oldest pending change was queued
+	since time.Time
+	// set while a batch is being written
+	writing bool
+	// every Queue gets a sequence number, written is the last one that's
+	// made it to the store
+	queued  int64
+	written int64
+	waiters []flushWaiter
+
+	wake chan bool
+	stop chan bool
+	done chan error
+
+	Timing   Timing
+	failures int64
+	// set while the store's past MAX_PERSIST_LAG, refused counts the
+	// actions turned away meanwhile
+	behind  bool
+	refused int64
+}
+
+type pendingRows struct {
+	players map[int]Row
+	zones   map[int]Row
+	items   map[int]Row
+}
+
+func newPendingRows() pendingRows {
+	return pendingRows{
+		players: make(map[int]Row),
+		zones:   make(map[int]Row),
+		items:   make(map[int]Row),
+	}
+}
+
+func (p pendingRows) len() int {
+	return len(p.players) + len(p.zones) + len(p.items)
+}
+
+// merge adds rows, replacing any already pending unless keepNewer is set,
+// which is used to put back rows from a failed write without clobbering
+// changes queued since.
+func (p pendingRows) merge(b Batch, keepNewer bool) {
+	add := func(m map[int]Row, rows []Row) {
+		for _, row := range rows {
+			if _, ok := m[row.Id]; ok && keepNewer {
+				continue
+			}
+			m[row.Id] = row
+		}
+	}
+	add(p.players, b.Players)
+	add(p.zones, b.Zones)
+	add(p.items, b.Items)
+}
+
+func (p pendingRows) batch() Batch {
+	rows := func(m map[int]Row) []Row {
+		list := make([]Row, 0, len(m))
+		for _, row := range m {
+			list = append(list, row)
+		}
+		return list
+	}
+	return Batch{Players: rows(p.players), Zones: rows(p.zones), Items: rows(p.items)}
+}
+
+type flushWaiter struct {
+	seq  int64
+	done chan bool
+}
+
+type PersistStats struct {
+	Timing   TimingStats
+	Failures int64
+	Refused  int64
+	Pending  int
+	// age of the oldest unsaved change, 0 if there's nothing waiting
+	Lag time.Duration
+}
+
+// NewPersister starts the worker, journal can be nil to run without one.
+// Sequence numbers carry on from seq, the store's CommittedSeq, so the
+// journal never reuses one the store has already recorded.
+func NewPersister(store Store, journal *Journal, seq int64) *Persister {
+	p := &Persister{
+		log:     log.New(os.Stdout, "[RPG/Persister] ", log.LstdFlags),
+		store:   store,
+		journal: journal,
+		pending: newPendingRows(),
+		queued:  seq,
+		written: seq,
+		wake:    make(chan bool, 1),
+		stop:    make(chan bool),
+		done:    make(chan error, 1),
+	}
+	go p.run()
+	return p
+}
+
+// Queue hands a snapshot to the worker, it never waits on the store.
+func (p *Persister) Queue(b Batch) {
+	if b.Len() == 0 {
+		return
+	}
+	p.mutex.Lock()
+	if p.pending.len() == 0 && !p.writing {
+		p.since = time.Now()
+	}
+	p.pending.merge(b, false)
+	p.queued += 1
+	if p.journal != nil {
+		p.journal.Add(p.queued, b)
+	}
+	p.mutex.Unlock()
+
+	select {
+	case p.wake <- true:
+	default:
+	}
+}
+
+// Refuse reports whether the oldest unsaved change is past MAX_PERSIST_LAG,
+// in which case the game turns player actions away until the store catches
+// up, so a dead DB stops play rather than letting it run on with nothing
+// saved. Every true is counted as a refused action.
+func (p *Persister) Refuse() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	behind := p.lag() > MAX_PERSIST_LAG
+	if behind != p.behind {
+		p.behind = behind
+		if behind {
+			p.log.Printf("WARNING: changes haven't been saved for over %v, refusing player actions until they are", MAX_PERSIST_LAG)
+		} else {
+			p.log.Printf("caught up after refusing %d actions", p.refused)
+		}
+	}
+	if behind {
+		p.refused += 1
+	}
+	return behind
+}
+
+// lag is how long the oldest unsaved change has been waiting, must be
+// called with the mutex held.
+func (p *Persister) lag() time.Duration {
+	if p.pending.len() > 0 || p.writing {
+		return time.Since(p.since)
+	}
+	return 0
+}
+
+// Flushed returns a channel that's closed once everything queued so far
+// has been written, later snapshots don't hold it up.
+func (p *Persister) Flushed() <-chan bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	done := make(chan bool)
+	if p.written >= p.queued {
+		close(done)
+	} else {
+		p.waiters = append(p.waiters, flushWaiter{p.queued, done})
+	}
+	return done
+}
+
+// Close writes whatever's left and stops the worker, returning the last
+// error if it couldn't all be saved.
+func (p *Persister) Close() error {
+	close(p.stop)
+	return <-p.done
+}
+
+func (p *Persister) Stats() PersistStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return PersistStats{
+		Timing:   p.Timing.Stats(),
+		Failures: p.failures,
+		Refused:  p.refused,
+		Pending:  p.pending.len(),
+		Lag:      p.lag(),
+	}
+}
+
+func (p *Persister) run() {
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-p.wake:
+			if retry != nil {
+				// already backing off, the retry picks this up
+				continue
+			}
+		case <-retry:
+			retry = nil
+		case <-p.stop:
+			p.done <- p.drain()
+			return
+		}
+
+		if err := p.write(); err != nil {
+			retry = time.After(COMMIT_RETRY_INTERVAL)
+		}
+	}
+}
+
+// write takes everything pending and commits it, on failure it goes back in
+// to be tried again.
+func (p *Persister) write() error {
+	p.mutex.Lock()
+	if p.pending.len() == 0 {
+		p.mutex.Unlock()
+		return nil
+	}
+	batch := p.pending.batch()
+	seq := p.queued
+	batch.Seq = seq
+	p.pending = newPendingRows()
+	p.writing = true
+	p.mutex.Unlock()
+
+	start := time.Now()
+	err := p.store.Commit(batch)
+	p.Timing.Record(start)
+
+	p.mutex.Lock()
+	p.writing = false
+	if err != nil {
+		p.failures += 1
+		p.pending.merge(batch, true)
+		p.mutex.Unlock()
+		p.log.Printf("commit of %d rows failed, retrying in %v: %v", batch.Len(), COMMIT_RETRY_INTERVAL, err)
+		return err
+	}
+
+	p.written = seq
+	if p.pending.len() > 0 {
+		// queued during the write, they've only been waiting since now-ish
+		p.since = start
+	}
+	waiting := p.waiters[:0]
+	for _, w := range p.waiters {
+		if w.seq <= seq {
+			close(w.done)
+		} else {
+			waiting = append(waiting, w)
+		}
+	}
+	p.waiters = waiting
+	p.mutex.Unlock()
+
+	// the journal can be stuck behind a slow fsync, Queue mustn't be
+	if p.journal != nil {
+		p.journal.Checkpoint(seq)
+	}
+	return nil
+}
+
+func (p *Persister) drain() error {
+	var err error
+	for attempt := 0; attempt < CLOSE_ATTEMPTS; attempt++ {
+		if err = p.write(); err == nil {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	if err != nil {
+		// the journal keeps them, they're replayed at the next startup
+		p.log.Printf("gave up saving %d rows: %v", p.Stats().Pending, err)
+	}
+	if p.journal != nil {
+		p.journal.Close()
+	}
+	return err
+}
@@ -0,0 +1,152 @@
+package rpg
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyStore fails commits while failing is set and keeps whatever it's
+// given otherwise.
+type flakyStore struct {
+	*MemoryStore
+	mutex   sync.Mutex
+	failing bool
+	commits int
+}
+
+func newFlakyStore() *flakyStore {
+	s, _ := NewMemoryStore("")
+	return &flakyStore{MemoryStore: s}
+}
+
+func (s *flakyStore) setFailing(failing bool) {
+	s.mutex.Lock()
+	s.failing = failing
+	s.mutex.Unlock()
+}
+
+func (s *flakyStore) Commit(b Batch) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.commits++
+	if s.failing {
+		return errors.New("store is down")
+	}
+	return s.MemoryStore.Commit(b)
+}
+
+func (s *flakyStore) zone(id int) string {
+	s.MemoryStore.mutex.Lock()
+	defer s.MemoryStore.mutex.Unlock()
+	return string(s.data.Zones[id])
+}
+
+func row(id int, data string) Row {
+	return Row{id, []byte(data)}
+}
+
+func TestPendingRowsMerge(t *testing.T) {
+	tests := []struct {
+		name      string
+		existing  []Row
+		incoming  []Row
+		keepNewer bool
+		want      map[int]string
+	}{
+		{"adds new rows", nil, []Row{row(1, `"a"`)}, false, map[int]string{1: `"a"`}},
+		{"newest wins", []Row{row(1, `"old"`)}, []Row{row(1, `"new"`)}, false, map[int]string{1: `"new"`}},
+		{"keepNewer leaves queued rows", []Row{row(1, `"queued"`)}, []Row{row(1, `"failed"`), row(2, `"b"`)}, true,
+			map[int]string{1: `"queued"`, 2: `"b"`}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := newPendingRows()
+			p.merge(Batch{Zones: test.existing}, false)
+			p.merge(Batch{Zones: test.incoming}, test.keepNewer)
+			if len(p.zones) != len(test.want) {
+				t.Fatalf("got %d rows, want %d", len(p.zones), len(test.want))
+			}
+			for id, want := range test.want {
+				if got := string(p.zones[id].Data); got != want {
+					t.Errorf("row %d = %s, want %s", id, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPersisterRetriesWithoutClobbering(t *testing.T) {
+	store := newFlakyStore()
+	store.setFailing(true)
+	p := NewPersister(store, nil, 0)
+
+	p.Queue(Batch{Zones: []Row{row(1, `"first"`)}})
+	for p.Stats().Failures == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// queued while the failed write is waiting to be retried, it has to
+	// win over the row that failed
+	p.Queue(Batch{Zones: []Row{row(1, `"second"`)}})
+	if pending := p.Stats().Pending; pending != 1 {
+		t.Fatalf("pending = %d, want 1", pending)
+	}
+
+	store.setFailing(false)
+	if err := p.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if got := store.zone(1); got != `"second"` {
+		t.Errorf("stored %s, want the newer row", got)
+	}
+}
+
+func TestPersisterRefusesWhileBehind(t *testing.T) {
+	store := newFlakyStore()
+	store.setFailing(true)
+	p := NewPersister(store, nil, 0)
+
+	p.Queue(Batch{Zones: []Row{row(1, `"first"`)}})
+	if p.Refuse() {
+		t.Fatalf("refused before falling behind")
+	}
+	p.mutex.Lock()
+	p.since = time.Now().Add(-MAX_PERSIST_LAG - time.Second)
+	p.mutex.Unlock()
+
+	// the game loop has to keep running while the store's down
+	queued := make(chan bool)
+	go func() {
+		p.Queue(Batch{Zones: []Row{row(1, `"second"`)}})
+		close(queued)
+	}()
+	select {
+	case <-queued:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Queue blocked while behind")
+	}
+	if !p.Refuse() || p.Stats().Refused != 1 {
+		t.Fatalf("actions weren't refused while behind")
+	}
+
+	store.setFailing(false)
+	if err := p.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if p.Refuse() {
+		t.Errorf("still refusing once everything's saved")
+	}
+}
+
+func TestPersisterCarriesOnFromCommittedSeq(t *testing.T) {
+	store := newFlakyStore()
+	p := NewPersister(store, nil, 5)
+	p.Queue(Batch{Zones: []Row{row(1, `"a"`)}})
+	if err := p.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if seq, _ := store.CommittedSeq(); seq != 6 {
+		t.Errorf("committed seq = %d, want 6", seq)
+	}
+}
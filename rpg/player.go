@@ -22,6 +22,9 @@ type Player struct {
 	Timers Timers     `json:"timers"`
 
 	Editing bool `json:"-"`
+	// connection dropped, but the player is kept in the world for a while
+	// in case they come back
+	Linkdead bool `json:"-"`
 }
 
 const (
@@ -157,5 +160,5 @@ func (p *Player) Tick(g *RPG, z *Zone, ci *CombatInfo) {
 }
 
 func (p *Player) IsTurnOver(ci *CombatInfo) bool {
-	return ci.Timer <= 0 || p.AP <= 0
+	return p.Linkdead || ci.Timer <= 0 || p.AP <= 0
 }
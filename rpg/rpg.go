@@ -1,10 +1,17 @@
 package rpg
 
 import (
-	"database/sql"
+	"errors"
 	"log"
+	"sync"
+	"time"
 )
 
+// Incoming and Outgoing are buffered so their depth can be measured, a
+// full buffer means the game loop or whatever's reading its output isn't
+// keeping up.
+const MESSAGE_QUEUE_SIZE = 64
+
 type RPG struct {
 	Defs    *Definitions
 	Zones   *ZoneDB
@@ -13,12 +20,31 @@ type RPG struct {
 
 	Incoming chan IncomingMessage
 	Outgoing chan OutgoingMessage
-	DB       *sql.DB
+
+	// set once the game has been saved for shutdown, anything after that
+	// is ignored
+	stopped bool
+
+	// writes changes in the background
+	persist *Persister
+	// everything's saved this often whether it's been marked or not, 0
+	// turns autosave off
+	AutosaveInterval time.Duration
+	lastAutosave     time.Time
+
+	TickTiming Timing
+	statsMutex sync.Mutex
+	zoneStats  []ZoneStats
 }
 
 type IncomingMessage struct {
 	PlayerId int
-	Data     IncomingMessageData
+	// set if the client wants an ack once the action's been handled
+	RequestId string
+	Data      IncomingMessageData
+	// set by internal callers that need to wait for the result, it's sent
+	// the same error the player would have been acked with
+	Done chan error
 }
 
 type OutgoingMessage struct {
@@ -43,39 +69,105 @@ type DisplayData struct {
 	AllZones  map[int]string `json:"allZones,omitempty"`
 }
 
-func NewRPG(defDir string, db *sql.DB) (*RPG, error) {
+// NewRPG loads the game from the store, journal can be nil to run without
+// one.
+func NewRPG(defDir string, store Store, journal *Journal) (*RPG, error) {
 	defs, err := LoadDefinitions(defDir)
 	if err != nil {
 		return nil, err
 	}
 
+	players, err := NewPlayerDB(store)
+	if err != nil {
+		return nil, err
+	}
+	items, err := NewItemDB(store)
+	if err != nil {
+		return nil, err
+	}
+	zones, err := NewZoneDB(store)
+	if err != nil {
+		return nil, err
+	}
+	seq, err := store.CommittedSeq()
+	if err != nil {
+		return nil, err
+	}
+
 	rpg := &RPG{
-		Defs:     defs,
-		Players:  NewPlayerDB(db),
-		Items:    NewItemDB(db),
-		Zones:    NewZoneDB(db),
-		Incoming: make(chan IncomingMessage),
-		Outgoing: make(chan OutgoingMessage),
-		DB:       db,
+		Defs:         defs,
+		Players:      players,
+		Items:        items,
+		Zones:        zones,
+		Incoming:     make(chan IncomingMessage, MESSAGE_QUEUE_SIZE),
+		Outgoing:     make(chan OutgoingMessage, MESSAGE_QUEUE_SIZE),
+		persist:      NewPersister(store, journal, seq),
+		lastAutosave: time.Now(),
 	}
 
 	for _, z := range rpg.Zones.AllZones {
 		rpg.InitZone(z)
 	}
 
+	// players spawn in zone 1, so a fresh store needs one to start with
+	if len(rpg.Zones.AllZones) == 0 {
+		z := &Zone{Name: "start"}
+		rpg.InitZone(z)
+		rpg.Zones.Insert(z)
+	}
+
 	return rpg, nil
 }
 
 func (g *RPG) HandleMessages() {
 	for {
 		incoming := <-g.Incoming
-		if incoming.Data.Type == ACTION_TICK {
+		if g.stopped {
+			g.Done(incoming, ErrShuttingDown)
+			continue
+		}
+		if incoming.Data.Type == ACTION_SHUTDOWN {
+			// the loop keeps draining messages while the last of the
+			// changes are written
+			g.Commit()
+			g.stopped = true
+			log.Printf("game loop stopped")
+			go func(msg IncomingMessage) {
+				g.Done(msg, g.persist.Close())
+			}(incoming)
+		} else if incoming.Data.Type == ACTION_TICK {
 			g.Tick()
 		} else if incoming.Data.Type == ACTION_JOIN {
 			g.PlayerJoin(incoming)
 		} else if incoming.Data.Type == ACTION_LEAVE {
 			g.PlayerLeave(incoming.PlayerId)
+		} else if incoming.Data.Type == ACTION_LINKDEAD {
+			g.PlayerSetLinkdead(incoming.PlayerId, true)
+		} else if incoming.Data.Type == ACTION_RESUME {
+			g.PlayerSetLinkdead(incoming.PlayerId, false)
+		} else if incoming.Data.Type == ACTION_SAVE {
+			saved := g.SaveAll()
+			go func(msg IncomingMessage) {
+				g.Done(msg, <-saved)
+			}(incoming)
+		} else if incoming.Data.Type == ACTION_SAY {
+			err := g.PlayerSay(incoming.PlayerId, incoming.Data.Params)
+			g.Done(incoming, err)
+		} else if incoming.Data.Type == ACTION_TELEPORT {
+			err := g.PlayerTeleport(incoming.PlayerId, incoming.Data.Params)
+			g.Done(incoming, err)
+		} else if incoming.Data.Type == ACTION_UNSTUCK {
+			g.Done(incoming, g.PlayerUnstuck(incoming.PlayerId))
+		} else if incoming.Data.Type == ACTION_SPAWN_NPC {
+			g.Done(incoming, g.SpawnNPC(incoming.PlayerId, incoming.Data.Params))
+		} else if incoming.Data.Type == ACTION_GIVE_ITEM {
+			g.Done(incoming, g.GiveItem(incoming.PlayerId, incoming.Data.Params))
 		} else {
+			if incoming.Data.Type != ACTION_RESYNC && g.persist.Refuse() {
+				g.Ack(incoming, ErrSavingBehind)
+				continue
+			}
+
 			p := g.Players.Get(incoming.PlayerId)
 			zone, ok := g.Zones.Get(p.CurrentZone)
 			if !ok {
@@ -88,18 +180,29 @@ func (g *RPG) HandleMessages() {
 					Zone:     1,
 					Type:     ACTION_UPDATE,
 				}
+				g.Ack(incoming, ErrActionFailed)
 				continue
 			}
 
 			if incoming.Data.Type == ACTION_EDIT {
-				g.HandleEdit(p, zone, incoming.Data.Params)
+				err := g.HandleEdit(p, zone, incoming.Data.Params)
+				g.Ack(incoming, err)
+				continue
+			}
+
+			if incoming.Data.Type == ACTION_RESYNC {
+				g.Outgoing <- OutgoingMessage{
+					PlayerId: p.Id,
+					Zone:     p.CurrentZone,
+					Type:     ACTION_UPDATE,
+				}
 				continue
 			}
 
 			if incoming.Data.Type == ACTION_FACE {
 				g.Players.SetDirty(p.Id)
-				g.PlayerFace(p, zone, incoming.Data.Params)
-				g.Players.Commit()
+				err := g.PlayerFace(p, zone, incoming.Data.Params)
+				g.Ack(incoming, err)
 				g.Outgoing <- OutgoingMessage{
 					PlayerId: p.Id,
 					Zone:     p.CurrentZone,
@@ -110,6 +213,7 @@ func (g *RPG) HandleMessages() {
 
 			if !g.CanAct(zone, p) {
 				log.Printf("player tried to act out of order %s", p.Name)
+				g.Ack(incoming, ErrNotYourTurn)
 				continue
 			}
 
@@ -117,30 +221,30 @@ func (g *RPG) HandleMessages() {
 
 			g.Players.SetDirty(p.Id)
 
+			var err error = ErrActionFailed
 			switch incoming.Data.Type {
 			case ACTION_MOVE:
-				g.PlayerMove(p, zone, incoming.Data.Params)
+				err = g.PlayerMove(p, zone, incoming.Data.Params)
 			case ACTION_USE:
-				g.PlayerUse(p, zone, incoming.Data.Params)
+				err = g.PlayerUse(p, zone, incoming.Data.Params)
 			case ACTION_TAKE_ITEM:
-				g.PlayerTakeItem(p, zone, incoming.Data.Params)
+				err = g.PlayerTakeItem(p, zone, incoming.Data.Params)
 			case ACTION_EQUIP_ITEM:
-				g.PlayerEquipItem(p, zone, incoming.Data.Params)
+				err = g.PlayerEquipItem(p, zone, incoming.Data.Params)
 			case ACTION_UNEQUIP_ITEM:
-				g.PlayerUnequipItem(p, zone, incoming.Data.Params)
+				err = g.PlayerUnequipItem(p, zone, incoming.Data.Params)
 			case ACTION_DROP_ITEM:
-				g.PlayerDropItem(p, zone, incoming.Data.Params)
+				err = g.PlayerDropItem(p, zone, incoming.Data.Params)
 			case ACTION_ATTACK:
-				g.PlayerAttack(p, zone, incoming.Data.Params)
+				err = g.PlayerAttack(p, zone, incoming.Data.Params)
 			}
+			g.Ack(incoming, err)
 
 			g.PostPlayerAction(zone, p)
 			g.BuildPlayer(p)
 			g.CheckCombat(zone)
 			g.BuildCollisionMap(zone)
 
-			g.Players.Commit()
-
 			if g.Zones.IsDirty(p.CurrentZone) {
 				g.Outgoing <- OutgoingMessage{
 					PlayerId: p.Id,
@@ -159,6 +263,34 @@ func (g *RPG) HandleMessages() {
 	}
 }
 
+// Ack tells the player how their action went. Rejections are always sent,
+// successes only if the player asked for an ack.
+func (g *RPG) Ack(msg IncomingMessage, err error) {
+	if err == nil && msg.RequestId == "" {
+		return
+	}
+	params := map[string]interface{}{
+		"id":      msg.RequestId,
+		"type":    msg.Data.Type,
+		"success": err == nil,
+	}
+	if err != nil {
+		params["error"] = err
+	}
+	g.Outgoing <- OutgoingMessage{
+		PlayerId: msg.PlayerId,
+		Type:     ACTION_ACK,
+		Params:   params,
+	}
+}
+
+// Done reports the result to an internal caller waiting on the message.
+func (g *RPG) Done(msg IncomingMessage, err error) {
+	if msg.Done != nil {
+		msg.Done <- err
+	}
+}
+
 func (g *RPG) PrepareDisplay() {
 	for _, z := range g.Zones.AllZones {
 		g.BuildDisplayData(z)
@@ -192,6 +324,9 @@ func (g *RPG) BuildDisplayFor(pId int) DisplayData {
 }
 
 func (g *RPG) Tick() {
+	defer g.TickTiming.Record(time.Now())
+	defer g.updateZoneStats()
+
 	for id, z := range g.Zones.AllZones {
 		g.ZoneTick(z)
 		if g.Zones.IsDirty(id) {
@@ -201,7 +336,24 @@ func (g *RPG) Tick() {
 			}
 		}
 	}
-	g.Zones.Commit()
+	g.Zones.ClearDirty()
+	if g.AutosaveInterval > 0 && time.Since(g.lastAutosave) >= g.AutosaveInterval {
+		g.Autosave()
+	}
+	g.Commit()
+}
+
+// Autosave marks every zone and online player unsaved, so changes that
+// were never marked dirty still make it to the store. Items are only ever
+// changed through Save so they're left alone.
+func (g *RPG) Autosave() {
+	g.lastAutosave = time.Now()
+	for id, z := range g.Zones.AllZones {
+		g.Zones.SetUnsaved(id)
+		for playerId := range z.Players {
+			g.Players.SetDirty(playerId)
+		}
+	}
 }
 
 func (g *RPG) PlayerJoin(msg IncomingMessage) {
@@ -216,6 +368,7 @@ func (g *RPG) PlayerJoin(msg IncomingMessage) {
 
 	p := g.Players.Get(msg.PlayerId)
 	p.Name = name
+	p.Linkdead = false
 	g.BuildPlayer(p)
 
 	if !ValidFace(p.Facing) {
@@ -242,6 +395,7 @@ func (g *RPG) PlayerJoin(msg IncomingMessage) {
 
 func (g *RPG) PlayerLeave(id int) {
 	p := g.Players.Get(id)
+	p.Linkdead = false
 	zone := p.CurrentZone
 	g.Players.SetDirty(id)
 	if z, ok := g.Zones.Get(p.CurrentZone); ok {
@@ -255,10 +409,128 @@ func (g *RPG) PlayerLeave(id int) {
 	}
 }
 
-func (g *RPG) SaveAll() {
+// PlayerSetLinkdead keeps the player in their zone (and combat) while their
+// connection is gone, their combat turns are skipped until they resume.
+func (g *RPG) PlayerSetLinkdead(id int, linkdead bool) {
+	p := g.Players.Get(id)
+	p.Linkdead = linkdead
+	if z, ok := g.Zones.Get(p.CurrentZone); ok {
+		g.Zones.SetDirty(z.Id)
+		g.Outgoing <- OutgoingMessage{
+			PlayerId: id,
+			Zone:     z.Id,
+			Type:     ACTION_UPDATE,
+		}
+	}
+}
+
+// PlayerTeleport moves a player to a zone, x and y default to -1 like
+// zone_goto. Players that aren't in the world are just moved in the DB.
+func (g *RPG) PlayerTeleport(id int, params ActionParams) error {
+	to, ok := params.getInt("zone")
+	if !ok {
+		return ErrInvalidParams
+	}
+	newZone, ok := g.Zones.Get(to)
+	if !ok {
+		return ErrUnknownTarget
+	}
+	x, ok := params.getInt("x")
+	if !ok {
+		x = -1
+	}
+	y, ok := params.getInt("y")
+	if !ok {
+		y = -1
+	}
+
+	p := g.Players.Get(id)
+	g.Players.SetDirty(id)
+
+	oldZone, online := g.Zones.Get(p.CurrentZone)
+	if online {
+		_, online = oldZone.Players[id]
+	}
+	if !online {
+		p.CurrentZone = newZone.Id
+		p.X = x
+		p.Y = y
+		return nil
+	}
+
+	g.RemovePlayer(oldZone, p)
+	g.AddPlayer(newZone, p, x, y)
+	g.BuildCollisionMap(newZone)
+
+	g.Zones.SetDirty(oldZone.Id)
+	g.Zones.SetDirty(newZone.Id)
+	g.Outgoing <- OutgoingMessage{
+		Zone: oldZone.Id,
+		Type: ACTION_UPDATE,
+	}
+	g.Outgoing <- OutgoingMessage{
+		PlayerId: id,
+		Zone:     newZone.Id,
+		Type:     ACTION_UPDATE,
+	}
+	return nil
+}
+
+var errSaveTimeout = errors.New("rpg: timed out waiting for save")
+
+// SaveAll queues everything changed and returns a channel that gets nil
+// once it's been written, or an error if that takes too long.
+func (g *RPG) SaveAll() <-chan error {
 	log.Printf("saving all")
-	g.Players.Commit()
-	g.Zones.Commit()
+	g.Commit()
+	result := make(chan error, 1)
+	flushed := g.persist.Flushed()
+	go func() {
+		select {
+		case <-flushed:
+			result <- nil
+		case <-time.After(MAX_PERSIST_LAG):
+			result <- errSaveTimeout
+		}
+	}()
+	return result
+}
+
+// Commit snapshots every changed player, zone and item and hands them to
+// the persister, it's run at the end of every tick.
+func (g *RPG) Commit() {
+	batch := Batch{}
+	for _, p := range g.Players.Unsaved() {
+		if row, err := NewRow(p.Id, p); err == nil {
+			batch.Players = append(batch.Players, row)
+		} else {
+			log.Printf("couldn't snapshot player %d: %v", p.Id, err)
+		}
+	}
+	for _, z := range g.Zones.Unsaved() {
+		if row, err := NewRow(z.Id, z); err == nil {
+			batch.Zones = append(batch.Zones, row)
+		} else {
+			log.Printf("couldn't snapshot zone %d: %v", z.Id, err)
+		}
+	}
+	for _, item := range g.Items.Unsaved() {
+		if row, err := NewRow(item.Id, item); err == nil {
+			batch.Items = append(batch.Items, row)
+		} else {
+			log.Printf("couldn't snapshot item %d: %v", item.Id, err)
+		}
+	}
+
+	g.persist.Queue(batch)
+	g.Players.Saved()
+	g.Zones.Saved()
+	g.Items.Saved()
+}
+
+// PersistStats is safe to call from other goroutines.
+func (g *RPG) PersistStats() PersistStats {
+	return g.persist.Stats()
 }
 
 func (g *RPG) KillPlayer(p *Player) {
@@ -0,0 +1,165 @@
+package rpg
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+)
+
+// Store is where players, zones and items live between runs. The game keeps
+// everything in memory and only goes to the store to load at startup and
+// to save changes.
+type Store interface {
+	LoadPlayers() (map[int]*Player, error)
+	LoadZones() (map[int]*Zone, error)
+	LoadItems() (map[int]Item, error)
+
+	// Commit saves a batch all or nothing, so a player's row and the items
+	// they're holding never disagree. The game numbers new zones and items
+	// itself, so zone and item rows are created if they don't exist yet.
+	Commit(b Batch) error
+	// CommittedSeq is the highest Batch.Seq committed so far.
+	CommittedSeq() (int64, error)
+}
+
+// Row is a player, zone or item already marshalled, so it can be written
+// from another goroutine while the game carries on changing the original.
+type Row struct {
+	Id   int             `json:"id"`
+	Data json.RawMessage `json:"data"`
+}
+
+func NewRow(id int, v interface{}) (Row, error) {
+	data, err := json.Marshal(v)
+	return Row{id, data}, err
+}
+
+// Batch is everything that's changed since the last commit.
+type Batch struct {
+	Players []Row `json:"players,omitempty"`
+	Zones   []Row `json:"zones,omitempty"`
+	Items   []Row `json:"items,omitempty"`
+	// the persister's sequence number for the newest snapshot in the batch,
+	// recorded along with the rows, 0 for writes from outside the game
+	Seq int64 `json:"-"`
+}
+
+func (b Batch) Len() int {
+	return len(b.Players) + len(b.Zones) + len(b.Items)
+}
+
+// PostgresStore keeps game data as JSON blobs in the players, zones and
+// items tables.
+type PostgresStore struct {
+	DB *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{DB: db}
+}
+
+func (s *PostgresStore) LoadPlayers() (map[int]*Player, error) {
+	rows, err := s.DB.Query(`SELECT id, data FROM players`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	players := make(map[int]*Player)
+	for rows.Next() {
+		var id int
+		var p Player
+		// players who've never joined have no data yet, Scan leaves them
+		// empty
+		if err := rows.Scan(&id, &p); err != nil {
+			return nil, err
+		}
+		p.Id = id
+		players[id] = &p
+	}
+	return players, rows.Err()
+}
+
+func (s *PostgresStore) LoadZones() (map[int]*Zone, error) {
+	rows, err := s.DB.Query(`SELECT id, data FROM zones`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	zones := make(map[int]*Zone)
+	for rows.Next() {
+		var id int
+		var z Zone
+		if err := rows.Scan(&id, &z); err != nil {
+			return nil, err
+		}
+		z.Id = id
+		zones[id] = &z
+	}
+	return zones, rows.Err()
+}
+
+func (s *PostgresStore) LoadItems() (map[int]Item, error) {
+	rows, err := s.DB.Query(`SELECT id, data FROM items`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := make(map[int]Item)
+	for rows.Next() {
+		var id int
+		var item Item
+		if err := rows.Scan(&id, &item); err != nil {
+			return nil, err
+		}
+		item.Id = id
+		items[id] = item
+	}
+	return items, rows.Err()
+}
+
+func (s *PostgresStore) Commit(b Batch) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	if err := commitTx(tx, b); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStore) CommittedSeq() (int64, error) {
+	var seq int64
+	err := s.DB.QueryRow(`SELECT seq FROM persist_checkpoint WHERE id = 1`).Scan(&seq)
+	return seq, err
+}
+
+func commitTx(tx *sql.Tx, b Batch) error {
+	for _, row := range b.Players {
+		if _, err := tx.Exec(`UPDATE players SET data = $1 WHERE id = $2`, []byte(row.Data), row.Id); err != nil {
+			return fmt.Errorf("player %d: %v", row.Id, err)
+		}
+	}
+	for _, row := range b.Zones {
+		if _, err := tx.Exec(`INSERT INTO zones (id, data) VALUES ($1, $2)
+            ON CONFLICT (id) DO UPDATE SET data = EXCLUDED.data`, row.Id, []byte(row.Data)); err != nil {
+			return fmt.Errorf("zone %d: %v", row.Id, err)
+		}
+	}
+	for _, row := range b.Items {
+		if _, err := tx.Exec(`INSERT INTO items (id, data) VALUES ($1, $2)
+            ON CONFLICT (id) DO UPDATE SET data = EXCLUDED.data`, row.Id, []byte(row.Data)); err != nil {
+			return fmt.Errorf("item %d: %v", row.Id, err)
+		}
+	}
+	if b.Seq > 0 {
+		if _, err := tx.Exec(`UPDATE persist_checkpoint SET seq = $1 WHERE id = 1`, b.Seq); err != nil {
+			return fmt.Errorf("checkpoint: %v", err)
+		}
+	}
+	return nil
+}
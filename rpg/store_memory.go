@@ -0,0 +1,140 @@
+package rpg
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// MemoryStore keeps game data in memory, for local development and tests.
+// Given a path it's also written out to a JSON file after every change and
+// read back at startup.
+type MemoryStore struct {
+	path  string
+	mutex sync.Mutex
+	data  memoryData
+}
+
+// everything's kept marshalled so the store never shares state with the
+// running game
+type memoryData struct {
+	Players map[int]json.RawMessage `json:"players"`
+	Zones   map[int]json.RawMessage `json:"zones"`
+	Items   map[int]json.RawMessage `json:"items"`
+	Seq     int64                   `json:"seq"`
+}
+
+func NewMemoryStore(path string) (*MemoryStore, error) {
+	s := &MemoryStore{
+		path: path,
+		data: memoryData{
+			Players: make(map[int]json.RawMessage),
+			Zones:   make(map[int]json.RawMessage),
+			Items:   make(map[int]json.RawMessage),
+		},
+	}
+	if path == "" {
+		return s, nil
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &s.data); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// flush writes the file, to a temp file first so a crash mid write doesn't
+// lose everything. Must be called with the mutex held.
+func (s *MemoryStore) flush() error {
+	if s.path == "" {
+		return nil
+	}
+	raw, err := json.Marshal(s.data)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, raw, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *MemoryStore) Commit(b Batch) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, row := range b.Players {
+		s.data.Players[row.Id] = row.Data
+	}
+	for _, row := range b.Zones {
+		s.data.Zones[row.Id] = row.Data
+	}
+	for _, row := range b.Items {
+		s.data.Items[row.Id] = row.Data
+	}
+	if b.Seq > 0 {
+		s.data.Seq = b.Seq
+	}
+	return s.flush()
+}
+
+func (s *MemoryStore) CommittedSeq() (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.data.Seq, nil
+}
+
+func (s *MemoryStore) LoadPlayers() (map[int]*Player, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	players := make(map[int]*Player)
+	for id, raw := range s.data.Players {
+		var p Player
+		if err := json.Unmarshal(raw, &p); err != nil {
+			return nil, err
+		}
+		p.Id = id
+		players[id] = &p
+	}
+	return players, nil
+}
+
+func (s *MemoryStore) LoadZones() (map[int]*Zone, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	zones := make(map[int]*Zone)
+	for id, raw := range s.data.Zones {
+		var z Zone
+		if err := json.Unmarshal(raw, &z); err != nil {
+			return nil, err
+		}
+		z.Id = id
+		zones[id] = &z
+	}
+	return zones, nil
+}
+
+func (s *MemoryStore) LoadItems() (map[int]Item, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	items := make(map[int]Item)
+	for id, raw := range s.data.Items {
+		var item Item
+		if err := json.Unmarshal(raw, &item); err != nil {
+			return nil, err
+		}
+		item.Id = id
+		items[id] = item
+	}
+	return items, nil
+}
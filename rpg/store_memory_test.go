@@ -0,0 +1,49 @@
+package rpg
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// the file backend is the memory one with a path, reopening it checks both
+func TestMemoryStoreRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "game.json")
+	store, err := NewMemoryStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	player, _ := NewRow(1, &Player{CurrentZone: 2, HP: 7})
+	zone, _ := NewRow(2, &Zone{Name: "start"})
+	item, _ := NewRow(3, Item{Name: "sword", Held: true, HeldBy: 1})
+	if err := store.Commit(Batch{Players: []Row{player}, Zones: []Row{zone}, Items: []Row{item}, Seq: 4}); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	// later commits replace rows
+	zone, _ = NewRow(2, &Zone{Name: "renamed"})
+	if err := store.Commit(Batch{Zones: []Row{zone}}); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	// everything has to come back from the file
+	if store, err = NewMemoryStore(path); err != nil {
+		t.Fatal(err)
+	}
+	players, err := store.LoadPlayers()
+	if err != nil || players[1] == nil || players[1].Id != 1 ||
+		players[1].CurrentZone != 2 || players[1].HP != 7 {
+		t.Errorf("LoadPlayers = %v, %v", players, err)
+	}
+	zones, err := store.LoadZones()
+	if err != nil || zones[2] == nil || zones[2].Name != "renamed" || zones[2].Id != 2 {
+		t.Errorf("LoadZones = %v, %v", zones, err)
+	}
+	items, err := store.LoadItems()
+	if err != nil || items[3].Name != "sword" || items[3].Id != 3 || items[3].HeldBy != 1 {
+		t.Errorf("LoadItems = %v, %v", items, err)
+	}
+	// batches from outside the game don't move it
+	if seq, err := store.CommittedSeq(); err != nil || seq != 4 {
+		t.Errorf("CommittedSeq = %d, %v, want 4", seq, err)
+	}
+}
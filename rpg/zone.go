@@ -21,6 +21,7 @@ type Zone struct {
 }
 
 type ZoneDisplayData struct {
+	Id                int          `json:"id"`
 	Name              string       `json:"name"`
 	Width             int          `json:"width"`
 	Height            int          `json:"height"`
@@ -172,6 +173,7 @@ func (g *RPG) BuildDisplayData(z *Zone) {
 		}
 	}
 	z.DisplayData = ZoneDisplayData{
+		Id:                z.Id,
 		Name:              z.Name,
 		Map:               tiles,
 		Entities:          entities,
@@ -221,6 +223,33 @@ func (g *RPG) SendMessage(z *Zone, player *Player, text string) {
 	}
 }
 
+// PlayerSay sends a chat message from a player to everyone in their zone,
+// emotes are shown as the player doing something rather than saying it.
+func (g *RPG) PlayerSay(id int, params ActionParams) error {
+	text, ok := params.getString("message")
+	if !ok {
+		return ErrInvalidParams
+	}
+	emote, _ := params["emote"].(bool)
+	p := g.Players.Get(id)
+	z, ok := g.Zones.Get(p.CurrentZone)
+	if !ok {
+		return ErrActionFailed
+	}
+	g.Outgoing <- OutgoingMessage{
+		PlayerId: -1,
+		Zone:     z.Id,
+		Type:     ACTION_CHAT,
+		Params: map[string]interface{}{
+			"message": text,
+			"from":    p.Name,
+			"fromId":  p.Id,
+			"emote":   emote,
+		},
+	}
+	return nil
+}
+
 type effectParams map[string]interface{}
 
 func (g *RPG) SendEffect(z *Zone, effectType string, params effectParams) {
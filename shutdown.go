@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/jdaiv/px-server/rpg"
+)
+
+const (
+	DEFAULT_SHUTDOWN_COUNTDOWN = 10
+	// how long closing sockets get to flush before we exit anyway
+	SHUTDOWN_CLOSE_TIMEOUT = 2 * time.Second
+)
+
+var shutdownCountdown = DEFAULT_SHUTDOWN_COUNTDOWN
+
+var shuttingDown int32
+
+func isShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+// shutdown stops the server in order, so nothing's mid-mutation when the
+// game is saved and clients get told why they were disconnected. A second
+// signal skips the countdown.
+func shutdown(srv *http.Server, stopTicker chan bool, signals chan os.Signal) {
+	atomic.StoreInt32(&shuttingDown, 1)
+
+	log.Println("[server] shutting down, no longer accepting connections")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	// websockets are hijacked so this doesn't wait on them, just on any
+	// plain http requests still in flight
+	srv.Shutdown(ctx)
+	cancel()
+
+	countdown(signals)
+
+	stopTicker <- true
+	log.Println("[server] stopped ticking, draining game loop")
+
+	// everything sent to the game loop before this is handled first, and
+	// the game saves before replying
+	err := runOnGameLoop(rpg.IncomingMessage{
+		Data: rpg.IncomingMessageData{Type: rpg.ACTION_SHUTDOWN},
+	})
+	if err != nil {
+		log.Printf("[server] error stopping game loop: %v", err)
+	} else {
+		log.Println("[server] game saved")
+	}
+
+	closeAllClients()
+	log.Println("[server] shutting down")
+}
+
+// countdown warns players before the server goes away.
+func countdown(signals chan os.Signal) {
+	clientsMutex.Lock()
+	online := len(authenticatedClients)
+	clientsMutex.Unlock()
+	if shutdownCountdown <= 0 || online == 0 {
+		return
+	}
+
+	for remaining := shutdownCountdown; remaining > 0; remaining-- {
+		if remaining == shutdownCountdown || remaining <= 5 || remaining%10 == 0 {
+			BroadcastToAll(ACTION_CHAT_MESSAGE, messageSend{
+				Content: fmt.Sprintf("server shutting down in %d seconds", remaining),
+				From:    "server",
+				Class:   MESSAGE_CLASS_SERVER,
+			})
+		}
+		select {
+		case <-time.After(time.Second):
+		case <-signals:
+			log.Println("[server] skipping shutdown countdown")
+			return
+		}
+	}
+}
+
+// closeAllClients sends every client a close frame and waits a little while
+// for them to be written.
+func closeAllClients() {
+	closing := make([]*Client, 0)
+	clientsMutex.Lock()
+	for c := range clients {
+		c.Close(ErrorShuttingDown, websocket.CloseGoingAway)
+		closing = append(closing, c)
+	}
+	clientsMutex.Unlock()
+
+	timeout := time.After(SHUTDOWN_CLOSE_TIMEOUT)
+	for _, c := range closing {
+		select {
+		case <-c.writerDone:
+		case <-timeout:
+			log.Printf("[server] gave up waiting on %d clients to close", len(closing))
+			return
+		}
+	}
+}
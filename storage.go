@@ -0,0 +1,298 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/jdaiv/px-server/rpg"
+)
+
+const (
+	STORAGE_POSTGRES = "postgres"
+	// nothing's kept once the server stops
+	STORAGE_MEMORY = "memory"
+	// JSON files in StoragePath
+	STORAGE_FILE = "file"
+
+	DEFAULT_STORAGE_PATH = "data"
+	DEFAULT_JOURNAL_PATH = "journal.jsonl"
+)
+
+// UserStore holds accounts. In postgres users and players share a table,
+// the other backends keep them apart.
+type UserStore interface {
+	CreateUser(name, nameNormal, hash string) (int, error)
+	// FindUser returns the user and their stored password, or
+	// ErrorUserMissing
+	FindUser(nameNormal string) (User, string, error)
+	SetPassword(id int, hash string) error
+	SetSuperUser(id int, superUser bool) error
+	// Passwords returns every user's stored password by id
+	Passwords() (map[int]string, error)
+}
+
+var users UserStore
+var gameStore rpg.Store
+var storage = STORAGE_POSTGRES
+
+func ValidStorage(storage string) bool {
+	switch storage {
+	case STORAGE_POSTGRES, STORAGE_MEMORY, STORAGE_FILE:
+		return true
+	}
+	return false
+}
+
+// hasDB is false when running without postgres, moderation, the admin
+// audit log and the chat log all need it.
+func hasDB() bool {
+	return DB != nil
+}
+
+// storageErr passes on client errors like ErrorNoDatabase and hides the
+// rest.
+func storageErr(err error) ClientError {
+	if cErr, ok := err.(ClientError); ok {
+		return cErr
+	}
+	return ErrorInternal
+}
+
+// OpenStorage sets up the configured backend, for postgres that's just
+// connecting, the schema's checked when the server starts.
+func OpenStorage(config Config) error {
+	storage = config.Storage
+	switch config.Storage {
+	case STORAGE_POSTGRES:
+		db, err := sql.Open("postgres", config.DBConnStr)
+		if err != nil {
+			return err
+		}
+		DB = db
+		log.Println("[server] connected to DB")
+		gameStore = rpg.NewPostgresStore(db)
+		users = &postgresUserStore{db}
+	case STORAGE_MEMORY:
+		gameStore, _ = rpg.NewMemoryStore("")
+		users, _ = newMemoryUserStore("")
+		log.Println("[server] using in-memory storage, nothing will be saved")
+	case STORAGE_FILE:
+		path := config.StoragePath
+		if path == "" {
+			path = DEFAULT_STORAGE_PATH
+		}
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return err
+		}
+		var err error
+		if gameStore, err = rpg.NewMemoryStore(filepath.Join(path, "game.json")); err != nil {
+			return fmt.Errorf("error loading game data: %v", err)
+		}
+		if users, err = newMemoryUserStore(filepath.Join(path, "users.json")); err != nil {
+			return fmt.Errorf("error loading users: %v", err)
+		}
+		log.Printf("[server] using file storage in %s", path)
+	default:
+		return fmt.Errorf("invalid storage %q", config.Storage)
+	}
+	return nil
+}
+
+// OpenJournal replays anything an unclean shutdown left in the journal into
+// the game store, then opens it for the game to write to. Returns nil when
+// the journal's turned off or there's nothing to recover into.
+func OpenJournal(config Config) (*rpg.Journal, error) {
+	if config.NoJournal || config.Storage == STORAGE_MEMORY {
+		return nil, nil
+	}
+	path := config.JournalPath
+	if path == "" && config.Storage == STORAGE_FILE {
+		dir := config.StoragePath
+		if dir == "" {
+			dir = DEFAULT_STORAGE_PATH
+		}
+		path = filepath.Join(dir, DEFAULT_JOURNAL_PATH)
+	} else if path == "" {
+		path = DEFAULT_JOURNAL_PATH
+	}
+
+	recovered, err := rpg.ReplayJournal(path, gameStore)
+	if err != nil {
+		return nil, fmt.Errorf("error replaying %s: %v", path, err)
+	}
+	if recovered > 0 {
+		log.Printf("[server] recovered %d rows from an unclean shutdown", recovered)
+	}
+	return rpg.OpenJournal(path)
+}
+
+type postgresUserStore struct {
+	db *sql.DB
+}
+
+func (s *postgresUserStore) CreateUser(name, nameNormal, hash string) (int, error) {
+	var id int
+	err := s.db.QueryRow(`INSERT INTO players(name, name_normal, password) VALUES ($1, $2, $3)
+        RETURNING id`, name, nameNormal, hash).Scan(&id)
+	return id, err
+}
+
+func (s *postgresUserStore) FindUser(nameNormal string) (User, string, error) {
+	user := User{}
+	var stored sql.NullString
+	err := s.db.QueryRow(`SELECT id, name, name_normal, superuser, password FROM players
+        WHERE name_normal = $1`, nameNormal).Scan(
+		&user.Id, &user.Name, &user.NameNormal, &user.SuperUser, &stored)
+	if err == sql.ErrNoRows {
+		return user, "", ErrorUserMissing
+	}
+	return user, stored.String, err
+}
+
+func (s *postgresUserStore) SetPassword(id int, hash string) error {
+	_, err := s.db.Exec(`UPDATE players SET password = $1 WHERE id = $2`, hash, id)
+	return err
+}
+
+func (s *postgresUserStore) SetSuperUser(id int, superUser bool) error {
+	_, err := s.db.Exec(`UPDATE players SET superuser = $1 WHERE id = $2`, superUser, id)
+	return err
+}
+
+func (s *postgresUserStore) Passwords() (map[int]string, error) {
+	rows, err := s.db.Query(`SELECT id, password FROM players`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	passwords := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var stored sql.NullString
+		if err := rows.Scan(&id, &stored); err != nil {
+			return nil, err
+		}
+		passwords[id] = stored.String
+	}
+	return passwords, rows.Err()
+}
+
+type storedUser struct {
+	User
+	Password string `json:"password"`
+}
+
+// memoryUserStore keeps users in memory, and in a JSON file if it's given
+// a path.
+type memoryUserStore struct {
+	path  string
+	mutex sync.Mutex
+	data  struct {
+		Users  map[int]storedUser `json:"users"`
+		LastId int                `json:"lastId"`
+	}
+}
+
+func newMemoryUserStore(path string) (*memoryUserStore, error) {
+	s := &memoryUserStore{path: path}
+	s.data.Users = make(map[int]storedUser)
+	if path == "" {
+		return s, nil
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &s.data); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// flush must be called with the mutex held.
+func (s *memoryUserStore) flush() error {
+	if s.path == "" {
+		return nil
+	}
+	raw, err := json.Marshal(s.data)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, raw, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *memoryUserStore) CreateUser(name, nameNormal, hash string) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, u := range s.data.Users {
+		if u.NameNormal == nameNormal {
+			return 0, fmt.Errorf("user %s already exists", nameNormal)
+		}
+	}
+	s.data.LastId += 1
+	id := s.data.LastId
+	s.data.Users[id] = storedUser{
+		User:     User{Id: id, Name: name, NameNormal: nameNormal},
+		Password: hash,
+	}
+	return id, s.flush()
+}
+
+func (s *memoryUserStore) FindUser(nameNormal string) (User, string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, u := range s.data.Users {
+		if u.NameNormal == nameNormal {
+			return u.User, u.Password, nil
+		}
+	}
+	return User{}, "", ErrorUserMissing
+}
+
+func (s *memoryUserStore) update(id int, f func(u *storedUser)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	u, ok := s.data.Users[id]
+	if !ok {
+		return ErrorUserMissing
+	}
+	f(&u)
+	s.data.Users[id] = u
+	return s.flush()
+}
+
+func (s *memoryUserStore) SetPassword(id int, hash string) error {
+	return s.update(id, func(u *storedUser) { u.Password = hash })
+}
+
+func (s *memoryUserStore) SetSuperUser(id int, superUser bool) error {
+	return s.update(id, func(u *storedUser) { u.SuperUser = superUser })
+}
+
+func (s *memoryUserStore) Passwords() (map[int]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	passwords := make(map[int]string)
+	for id, u := range s.data.Users {
+		passwords[id] = u.Password
+	}
+	return passwords, nil
+}
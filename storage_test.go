@@ -0,0 +1,51 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// the file backend is the memory one with a path, reopening it checks both
+func TestMemoryUserStoreRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	store, err := newMemoryUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := store.CreateUser("Alice", "alice", "hash")
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	if _, err := store.CreateUser("ALICE", "alice", "other"); err == nil {
+		t.Errorf("created a second alice")
+	}
+	if err := store.SetSuperUser(id, true); err != nil {
+		t.Fatalf("SetSuperUser: %v", err)
+	}
+	if err := store.SetPassword(id, "new hash"); err != nil {
+		t.Fatalf("SetPassword: %v", err)
+	}
+	if err := store.SetPassword(id+1, "x"); err != ErrorUserMissing {
+		t.Errorf("SetPassword on a missing user = %v, want ErrorUserMissing", err)
+	}
+
+	if store, err = newMemoryUserStore(path); err != nil {
+		t.Fatal(err)
+	}
+	user, password, err := store.FindUser("alice")
+	if err != nil {
+		t.Fatalf("FindUser: %v", err)
+	}
+	want := User{Id: id, Name: "Alice", NameNormal: "alice", SuperUser: true}
+	if user != want || password != "new hash" {
+		t.Errorf("FindUser = %+v, %q, want %+v, %q", user, password, want, "new hash")
+	}
+	if _, _, err := store.FindUser("bob"); err != ErrorUserMissing {
+		t.Errorf("FindUser(bob) = %v, want ErrorUserMissing", err)
+	}
+	passwords, err := store.Passwords()
+	if err != nil || len(passwords) != 1 || passwords[id] != "new hash" {
+		t.Errorf("Passwords = %v, %v", passwords, err)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TOKEN_TYPE_ACCESS  = "access"
+	TOKEN_TYPE_REFRESH = "refresh"
+
+	DEFAULT_ACCESS_TOKEN_LIFETIME  = 15 * time.Minute
+	DEFAULT_REFRESH_TOKEN_LIFETIME = 30 * 24 * time.Hour
+)
+
+var accessTokenLifetime = DEFAULT_ACCESS_TOKEN_LIFETIME
+var refreshTokenLifetime = DEFAULT_REFRESH_TOKEN_LIFETIME
+
+// tokens are standard HS256 JWTs signed with JWTSecret
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+type TokenClaims struct {
+	Subject    int    `json:"sub"`
+	NameNormal string `json:"name"`
+	Type       string `json:"typ"`
+	// the session id is shared by every token issued from a single login,
+	// so refreshing doesn't start a new session
+	Session   string `json:"sid"`
+	Id        string `json:"jti"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+type authTokens struct {
+	User         User   `json:"user"`
+	Token        string `json:"token"`
+	Expires      int64  `json:"expires"`
+	RefreshToken string `json:"refreshToken"`
+}
+
+// revoked sessions and used refresh tokens are kept in memory until the
+// tokens would have expired anyway
+var revokedMutex = &sync.Mutex{}
+var revokedSessions = make(map[string]int64)
+var usedRefreshTokens = make(map[string]int64)
+
+func randomId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func signToken(payload string) string {
+	mac := hmac.New(sha256.New, JWTSecret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func makeToken(user User, tokenType, session string, lifetime time.Duration) (string, TokenClaims, error) {
+	now := time.Now()
+	claims := TokenClaims{
+		Subject:    user.Id,
+		NameNormal: user.NameNormal,
+		Type:       tokenType,
+		Session:    session,
+		Id:         randomId(),
+		IssuedAt:   now.Unix(),
+		ExpiresAt:  now.Add(lifetime).Unix(),
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", claims, err
+	}
+
+	unsigned := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + signToken(unsigned), claims, nil
+}
+
+// IssueTokens creates an access and refresh token pair, pass an empty
+// session to start a new one.
+func IssueTokens(user User, session string) (authTokens, error) {
+	if session == "" {
+		session = randomId()
+	}
+
+	access, claims, err := makeToken(user, TOKEN_TYPE_ACCESS, session, accessTokenLifetime)
+	if err != nil {
+		return authTokens{}, err
+	}
+	refresh, _, err := makeToken(user, TOKEN_TYPE_REFRESH, session, refreshTokenLifetime)
+	if err != nil {
+		return authTokens{}, err
+	}
+
+	return authTokens{
+		User:         user,
+		Token:        access,
+		Expires:      claims.ExpiresAt,
+		RefreshToken: refresh,
+	}, nil
+}
+
+// ParseToken checks the signature, expiry, type and revocation status of a
+// token and returns its claims.
+func ParseToken(token, tokenType string) (TokenClaims, error) {
+	var claims TokenClaims
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != tokenHeader {
+		return claims, ErrorInvalidToken
+	}
+
+	expected := signToken(parts[0] + "." + parts[1])
+	if !hmac.Equal([]byte(expected), []byte(parts[2])) {
+		return claims, ErrorInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, ErrorInvalidToken
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, ErrorInvalidToken
+	}
+
+	if claims.Type != tokenType {
+		return claims, ErrorInvalidToken
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return claims, ErrorTokenExpired
+	}
+	if SessionRevoked(claims.Session) {
+		return claims, ErrorInvalidToken
+	}
+
+	return claims, nil
+}
+
+func pruneRevoked() {
+	now := time.Now().Unix()
+	for s, expires := range revokedSessions {
+		if now >= expires {
+			delete(revokedSessions, s)
+		}
+	}
+	for id, expires := range usedRefreshTokens {
+		if now >= expires {
+			delete(usedRefreshTokens, id)
+		}
+	}
+}
+
+func RevokeSession(session string) {
+	revokedMutex.Lock()
+	defer revokedMutex.Unlock()
+
+	pruneRevoked()
+	revokedSessions[session] = time.Now().Add(refreshTokenLifetime).Unix()
+}
+
+// ConsumeRefreshToken marks a refresh token as used. Refresh tokens are
+// single use, if one turns up twice it's probably been stolen so the whole
+// session is revoked.
+func ConsumeRefreshToken(claims TokenClaims) bool {
+	revokedMutex.Lock()
+	defer revokedMutex.Unlock()
+
+	pruneRevoked()
+	if _, used := usedRefreshTokens[claims.Id]; used {
+		revokedSessions[claims.Session] = time.Now().Add(refreshTokenLifetime).Unix()
+		return false
+	}
+	usedRefreshTokens[claims.Id] = claims.ExpiresAt
+	return true
+}
+
+func SessionRevoked(session string) bool {
+	revokedMutex.Lock()
+	defer revokedMutex.Unlock()
+
+	_, revoked := revokedSessions[session]
+	return revoked
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseToken(t *testing.T) {
+	JWTSecret = []byte("test secret")
+	user := User{Id: 7, NameNormal: "alice"}
+
+	valid, _, _ := makeToken(user, TOKEN_TYPE_ACCESS, "session", time.Minute)
+	expired, _, _ := makeToken(user, TOKEN_TYPE_ACCESS, "session", -time.Minute)
+	refresh, _, _ := makeToken(user, TOKEN_TYPE_REFRESH, "session", time.Minute)
+	revoked, _, _ := makeToken(user, TOKEN_TYPE_ACCESS, "revoked", time.Minute)
+	RevokeSession("revoked")
+	parts := strings.Split(valid, ".")
+	tampered := parts[0] + "." + parts[1] + "x." + parts[2]
+
+	JWTSecret = []byte("another secret")
+	otherSecret, _, _ := makeToken(user, TOKEN_TYPE_ACCESS, "session", time.Minute)
+	JWTSecret = []byte("test secret")
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"valid", valid, nil},
+		{"expired", expired, ErrorTokenExpired},
+		{"wrong type", refresh, ErrorInvalidToken},
+		{"revoked session", revoked, ErrorInvalidToken},
+		{"tampered payload", tampered, ErrorInvalidToken},
+		{"signed with another secret", otherSecret, ErrorInvalidToken},
+		{"garbage", "not.a.token", ErrorInvalidToken},
+		{"empty", "", ErrorInvalidToken},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims, err := ParseToken(test.token, TOKEN_TYPE_ACCESS)
+			if err != test.want {
+				t.Fatalf("ParseToken = %v, want %v", err, test.want)
+			}
+			if err == nil && (claims.Subject != 7 || claims.NameNormal != "alice" || claims.Session != "session") {
+				t.Errorf("claims = %+v", claims)
+			}
+		})
+	}
+}
+
+func TestConsumeRefreshToken(t *testing.T) {
+	JWTSecret = []byte("test secret")
+	tokens, err := IssueTokens(User{Id: 1, NameNormal: "bob"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := ParseToken(tokens.RefreshToken, TOKEN_TYPE_REFRESH)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !ConsumeRefreshToken(claims) {
+		t.Fatalf("first use was refused")
+	}
+	// a reused refresh token revokes the whole session
+	if ConsumeRefreshToken(claims) {
+		t.Errorf("second use was allowed")
+	}
+	if _, err := ParseToken(tokens.Token, TOKEN_TYPE_ACCESS); err != ErrorInvalidToken {
+		t.Errorf("access token from the reused session = %v, want ErrorInvalidToken", err)
+	}
+}
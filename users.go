@@ -1,12 +1,13 @@
 package main
 
 import (
-	"database/sql"
+	"crypto/subtle"
 	"log"
 	"strings"
 	"unicode"
 
 	"github.com/sethvargo/go-password/password"
+	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/text/unicode/norm"
 )
 
@@ -14,6 +15,7 @@ const (
 	USERNAME_MIN_LENGTH = 1
 	USERNAME_MAX_LENGTH = 32
 	PASSWORD_LENGTH     = 60
+	PASSWORD_HASH_COST  = 12
 )
 
 type User struct {
@@ -29,6 +31,17 @@ func createPassword() []byte {
 	return []byte(p)
 }
 
+func hashPassword(password []byte) ([]byte, error) {
+	return bcrypt.GenerateFromPassword(password, PASSWORD_HASH_COST)
+}
+
+// isPasswordHash tells bcrypt hashes apart from plaintext passwords stored
+// before hashing was introduced.
+func isPasswordHash(stored string) bool {
+	_, err := bcrypt.Cost([]byte(stored))
+	return err == nil
+}
+
 func normalizeUsername(username string) string {
 	return norm.NFKD.String(strings.ToLower(norm.NFKD.String(username)))
 }
@@ -60,48 +73,98 @@ func ValidateUsername(username string) error {
 func CreateUser(username string) (User, string, error) {
 	user := User{NameNormal: normalizeUsername(username)}
 	password := createPassword()
-	var id int
 
-	err := DB.QueryRow(`INSERT INTO players(name, name_normal, password) VALUES ($1, $2, $3)
-        RETURNING id`, username, user.NameNormal, password).Scan(&id)
+	hash, err := hashPassword(password)
+	if err != nil {
+		log.Printf("Error hashing password: %v", err)
+		return user, "", err
+	}
+
+	id, err := users.CreateUser(username, user.NameNormal, string(hash))
 	if err != nil {
-		log.Printf("SQL Error: %v", err)
+		log.Printf("Error creating user: %v", err)
 		return user, "", err
 	}
 
 	log.Printf("User created, ID: %d", id)
+	user.Id = id
 	user.Name = username
 	return user, string(password), nil
 }
 
-func AuthenticateUser(password string) (User, error) {
-	user := User{}
-
-	err := DB.QueryRow(`SELECT id, name, name_normal, superuser FROM players
-        WHERE password = $1`, password).Scan(&user.Id, &user.Name, &user.NameNormal, &user.SuperUser)
+func AuthenticateUser(username, password string) (User, error) {
+	user, stored, err := users.FindUser(normalizeUsername(username))
 	if err != nil {
-		log.Printf("SQL Error: %v", err)
-		if err == sql.ErrNoRows {
+		if err == ErrorUserMissing {
 			return user, ErrorInvalidLogin
 		}
+		log.Printf("Error loading user: %v", err)
 		return user, err
 	}
 
-	return user, nil
+	if isPasswordHash(stored) {
+		if bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) != nil {
+			return user, ErrorInvalidLogin
+		}
+		return user, checkBanned(user)
+	}
+
+	// legacy plaintext row that missed the migration, check it and hash it
+	// now so it doesn't stay plaintext
+	if subtle.ConstantTimeCompare([]byte(stored), []byte(password)) != 1 {
+		return user, ErrorInvalidLogin
+	}
+	if err := setPasswordHash(user.Id, []byte(password)); err != nil {
+		log.Printf("Failed to rehash password for %s: %v", user.NameNormal, err)
+	}
+
+	return user, checkBanned(user)
 }
 
-func LoadUser(username string) (User, error) {
-	user := User{NameNormal: username}
+func setPasswordHash(id int, password []byte) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	return users.SetPassword(id, string(hash))
+}
 
-	err := DB.QueryRow(`SELECT id, name, superuser FROM players
-        WHERE name_normal = $1`, username).Scan(&user.Id, &user.Name, &user.SuperUser)
+// MigratePasswords hashes every password that's still stored as plaintext,
+// it's safe to run more than once.
+func MigratePasswords() (int, error) {
+	passwords, err := users.Passwords()
 	if err != nil {
-		log.Printf("SQL Error: %v", err)
-		if err == sql.ErrNoRows {
-			return user, ErrorUserMissing
+		return 0, err
+	}
+
+	plaintext := make(map[int]string)
+	for id, stored := range passwords {
+		if stored != "" && !isPasswordHash(stored) {
+			plaintext[id] = stored
 		}
-		return user, err
 	}
 
-	return user, nil
+	migrated := 0
+	for id, password := range plaintext {
+		if err := setPasswordHash(id, []byte(password)); err != nil {
+			return migrated, err
+		}
+		migrated++
+		log.Printf("Hashed password for player %d", id)
+	}
+
+	return migrated, nil
+}
+
+func LoadUser(username string) (User, error) {
+	user, _, err := users.FindUser(username)
+	if err != nil && err != ErrorUserMissing {
+		log.Printf("Error loading user: %v", err)
+	}
+	user.NameNormal = username
+	return user, err
+}
+
+func SetSuperUser(id int, superUser bool) error {
+	return users.SetSuperUser(id, superUser)
 }